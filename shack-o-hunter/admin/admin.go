@@ -1,96 +1,77 @@
 package admin
 
 import (
+	"fmt"
 	"log"
-	"os"
 	"os/exec"
-	"strings"
-	"syscall"
-	"unsafe"
 )
 
-var (
-	shell32       = syscall.NewLazyDLL("shell32.dll")
-	shellExecuteW = shell32.NewProc("ShellExecuteW")
-)
+// Platform is the operating system specific part of the package: privilege
+// detection, elevation and the system trust store
+type Platform interface {
+	// IsAdmin checks if the current process can write to the system trust store
+	IsAdmin() bool
+	// RequestElevation restarts the program with administrator privileges.
+	// It only returns on failure.
+	RequestElevation() error
+	// InstallCert adds a PEM certificate file to the system trust store
+	InstallCert(certPath string) error
+	// UninstallCert removes the certificate with the given common name
+	UninstallCert(certName string) error
+	// IsCertInstalled checks if the certificate with the given common name is trusted
+	IsCertInstalled(certName string) bool
+}
+
+// current is set by the platform file matching the build target
+var current Platform = unsupported{}
+
+// Current returns the implementation for the running operating system
+func Current() Platform {
+	return current
+}
 
 // IsAdmin checks if the current process is running with administrator privileges
 func IsAdmin() bool {
-	_, err := os.Open("\\\\.\\PHYSICALDRIVE0")
-	if err != nil {
-		return false
-	}
-	return true
+	return current.IsAdmin()
 }
 
 // RequestElevation restarts the program with administrator privileges
 func RequestElevation() error {
-	verb := "runas"
-	exe, err := os.Executable()
-	if err != nil {
-		return err
-	}
-
-	cwd, _ := os.Getwd()
-	args := strings.Join(os.Args[1:], " ")
-
-	verbPtr, _ := syscall.UTF16PtrFromString(verb)
-	exePtr, _ := syscall.UTF16PtrFromString(exe)
-	cwdPtr, _ := syscall.UTF16PtrFromString(cwd)
-	argPtr, _ := syscall.UTF16PtrFromString(args)
-
-	var showCmd int32 = 1
-
-	ret, _, _ := shellExecuteW.Call(
-		0,
-		uintptr(unsafe.Pointer(verbPtr)),
-		uintptr(unsafe.Pointer(exePtr)),
-		uintptr(unsafe.Pointer(argPtr)),
-		uintptr(unsafe.Pointer(cwdPtr)),
-		uintptr(showCmd),
-	)
-
-	if ret <= 32 {
-		return syscall.Errno(ret)
-	}
-
-	os.Exit(0)
-	return nil
+	return current.RequestElevation()
 }
 
-// InstallCertToSystemStore installs the CA certificate to Windows Trusted Root store
+// InstallCertToSystemStore installs the CA certificate to the system trust store
 func InstallCertToSystemStore(certPath string) error {
+	return current.InstallCert(certPath)
+}
 
-	cmd := exec.Command("certutil", "-addstore", "-f", "Root", certPath)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		log.Printf("Erreur lors de l'installation du certificat: %v\nSortie: %s", err, output)
-		return err
-	}
+// UninstallCertFromSystemStore removes the CA certificate from the system trust store
+func UninstallCertFromSystemStore(certName string) error {
+	return current.UninstallCert(certName)
+}
 
-	log.Printf("Certificat CA installé avec succès dans le magasin système")
-	log.Printf("Sortie certutil: %s", output)
-	return nil
+// IsCertInstalledInSystemStore checks if the certificate is already installed
+func IsCertInstalledInSystemStore(certName string) bool {
+	return current.IsCertInstalled(certName)
 }
 
-// UninstallCertFromSystemStore removes the CA certificate from Windows Trusted Root store
-func UninstallCertFromSystemStore(certName string) error {
-	log.Printf("Suppression du certificat CA du magasin système...")
+// unsupported is used on systems without a trust store backend
+type unsupported struct{}
+
+var errUnsupported = fmt.Errorf("system trust store not supported on this platform")
 
-	cmd := exec.Command("certutil", "-delstore", "Root", certName)
-	output, err := cmd.CombinedOutput()
+func (unsupported) IsAdmin() bool               { return false }
+func (unsupported) RequestElevation() error     { return errUnsupported }
+func (unsupported) InstallCert(string) error    { return errUnsupported }
+func (unsupported) UninstallCert(string) error  { return errUnsupported }
+func (unsupported) IsCertInstalled(string) bool { return false }
+
+// run executes a command and logs its output on failure
+func run(name string, args ...string) error {
+	output, err := exec.Command(name, args...).CombinedOutput()
 	if err != nil {
-		log.Printf("Avertissement lors de la suppression du certificat: %v\nSortie: %s", err, output)
-		return err
+		log.Printf("Erreur %s: %v\nSortie: %s", name, err, output)
+		return fmt.Errorf("%s: %v", name, err)
 	}
-
-	log.Printf("Certificat CA supprimé du magasin système")
 	return nil
 }
-
-// IsCertInstalledInSystemStore checks if the certificate is already installed
-func IsCertInstalledInSystemStore(certName string) bool {
-	cmd := exec.Command("certutil", "-verifystore", "Root", certName)
-	err := cmd.Run()
-	return err == nil
-}
@@ -0,0 +1,37 @@
+//go:build darwin
+
+package admin
+
+import (
+	"os/exec"
+)
+
+const systemKeychain = "/Library/Keychains/System.keychain"
+
+// darwinPlatform uses the security tool on the System keychain
+type darwinPlatform struct{}
+
+func init() {
+	current = darwinPlatform{}
+}
+
+func (darwinPlatform) IsAdmin() bool {
+	return isRoot()
+}
+
+func (darwinPlatform) RequestElevation() error {
+	// -E keeps the SHACKODODO_* variables
+	return reexec([]string{"sudo", "-E"})
+}
+
+func (darwinPlatform) InstallCert(certPath string) error {
+	return run("security", "add-trusted-cert", "-d", "-r", "trustRoot", "-k", systemKeychain, certPath)
+}
+
+func (darwinPlatform) UninstallCert(certName string) error {
+	return run("security", "delete-certificate", "-c", certName, systemKeychain)
+}
+
+func (darwinPlatform) IsCertInstalled(certName string) bool {
+	return exec.Command("security", "find-certificate", "-c", certName, systemKeychain).Run() == nil
+}
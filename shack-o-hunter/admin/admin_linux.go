@@ -0,0 +1,123 @@
+//go:build linux
+
+package admin
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// debianAnchor is where update-ca-certificates picks up local CAs. The file
+// name is fixed so that the certificate can be found again to remove it.
+const debianAnchor = "/usr/local/share/ca-certificates/shackododo-ca.crt"
+
+// linuxPlatform uses update-ca-certificates on Debian-like systems and
+// p11-kit's trust tool elsewhere (Fedora, Arch, openSUSE)
+type linuxPlatform struct{}
+
+func init() {
+	current = linuxPlatform{}
+}
+
+func (linuxPlatform) IsAdmin() bool {
+	return isRoot()
+}
+
+// RequestElevation prefers pkexec in a graphical session, sudo otherwise
+func (linuxPlatform) RequestElevation() error {
+	var launchers [][]string
+	if os.Getenv("DISPLAY") != "" || os.Getenv("WAYLAND_DISPLAY") != "" {
+		launchers = append(launchers, []string{"pkexec"})
+	}
+	// -E keeps the SHACKODODO_* variables
+	launchers = append(launchers, []string{"sudo", "-E"})
+	return reexec(launchers...)
+}
+
+func (linuxPlatform) InstallCert(certPath string) error {
+	if useUpdateCACertificates() {
+		data, err := os.ReadFile(certPath)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(debianAnchor, data, 0o644); err != nil {
+			return err
+		}
+		return run("update-ca-certificates")
+	}
+	if hasCommand("trust") {
+		return run("trust", "anchor", "--store", certPath)
+	}
+	return fmt.Errorf("neither update-ca-certificates nor trust found")
+}
+
+func (linuxPlatform) UninstallCert(certName string) error {
+	if useUpdateCACertificates() {
+		if err := os.Remove(debianAnchor); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return run("update-ca-certificates", "--fresh")
+	}
+	if hasCommand("trust") {
+		uri := trustAnchorURI(certName)
+		if uri == "" {
+			return fmt.Errorf("certificate %q not found in the trust store", certName)
+		}
+		return run("trust", "anchor", "--remove", uri)
+	}
+	return fmt.Errorf("neither update-ca-certificates nor trust found")
+}
+
+func (linuxPlatform) IsCertInstalled(certName string) bool {
+	if useUpdateCACertificates() {
+		_, err := os.Stat(debianAnchor)
+		return err == nil
+	}
+	return hasCommand("trust") && trustAnchorURI(certName) != ""
+}
+
+// useUpdateCACertificates tells whether the Debian layout is available
+func useUpdateCACertificates() bool {
+	if !hasCommand("update-ca-certificates") {
+		return false
+	}
+	info, err := os.Stat(filepath.Dir(debianAnchor))
+	return err == nil && info.IsDir()
+}
+
+func hasCommand(name string) bool {
+	_, err := exec.LookPath(name)
+	return err == nil
+}
+
+// trustAnchorURI returns the PKCS#11 URI of the anchor with the given label,
+// parsed from "trust list" blocks:
+//
+//	pkcs11:id=...;type=cert
+//	    type: certificate
+//	    label: ShackoDodo Proxy CA
+func trustAnchorURI(label string) string {
+	output, err := exec.Command("trust", "list", "--filter=ca-anchors").Output()
+	if err != nil {
+		return ""
+	}
+
+	var uri string
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "pkcs11:") {
+			uri = line
+			continue
+		}
+		if value, ok := strings.CutPrefix(strings.TrimSpace(line), "label: "); ok && value == label {
+			return uri
+		}
+	}
+	return ""
+}
@@ -0,0 +1,47 @@
+//go:build linux || darwin
+
+package admin
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// isRoot checks the effective user, which is what the trust store checks
+func isRoot() bool {
+	return os.Geteuid() == 0
+}
+
+// reexec runs the program again through the first available launcher,
+// e.g. pkexec or sudo, then exits with the elevated process' status.
+// Each launcher is the command followed by its own arguments.
+func reexec(launchers ...[]string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	for _, launcher := range launchers {
+		path, err := exec.LookPath(launcher[0])
+		if err != nil {
+			continue
+		}
+
+		args := append(append(launcher[1:len(launcher):len(launcher)], exe), os.Args[1:]...)
+		cmd := exec.Command(path, args...)
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) {
+				os.Exit(exitErr.ExitCode())
+			}
+			return fmt.Errorf("%s: %v", launcher[0], err)
+		}
+		os.Exit(0)
+	}
+	return fmt.Errorf("no elevation tool found, run as root or use -no-privilege")
+}
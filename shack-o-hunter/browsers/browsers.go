@@ -3,10 +3,13 @@ package browsers
 import (
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"proxy-interceptor/cert"
+	"proxy-interceptor/config"
+	"strconv"
 	"strings"
 )
 
@@ -93,13 +96,24 @@ func DetectAvailableBrowsers() []Browser {
 	return available
 }
 
+// proxyHostPort returns the address browsers must use to reach the proxy
+func proxyHostPort() (string, int) {
+	cfg := config.GetInstance()
+	host := cfg.ProxyAddress
+	if host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+	return host, cfg.ProxyPort
+}
+
 func createFirefoxProfile(profilePath string) error {
+	proxyHost, proxyPort := proxyHostPort()
 	userJS := []string{
 		`user_pref("network.proxy.type", 1);`,
-		`user_pref("network.proxy.http", "127.0.0.1");`,
-		`user_pref("network.proxy.http_port", 8181);`,
-		`user_pref("network.proxy.ssl", "127.0.0.1");`,
-		`user_pref("network.proxy.ssl_port", 8181);`,
+		fmt.Sprintf(`user_pref("network.proxy.http", %q);`, proxyHost),
+		fmt.Sprintf(`user_pref("network.proxy.http_port", %d);`, proxyPort),
+		fmt.Sprintf(`user_pref("network.proxy.ssl", %q);`, proxyHost),
+		fmt.Sprintf(`user_pref("network.proxy.ssl_port", %d);`, proxyPort),
 		`user_pref("network.proxy.no_proxies_on", "");`,
 		`user_pref("network.proxy.bypass_on_local", false);`,
 		`user_pref("network.proxy.allow_hijacking_localhost", true);`,
@@ -148,10 +162,11 @@ func createFirefoxProfile(profilePath string) error {
 }
 
 func setupChromeProfile(profilePath string) error {
+	proxyHost, proxyPort := proxyHostPort()
 	prefsJSON := `{
 		"proxy": {
 			"mode": "fixed_servers",
-			"server": "127.0.0.1:8181"
+			"server": "` + net.JoinHostPort(proxyHost, strconv.Itoa(proxyPort)) + `"
 		},
 		"ssl": {
 			"version_min": "tls1",
@@ -244,6 +259,8 @@ func StartBrowser(browser Browser) error {
 	}
 
 	startURL := "http://www.example.com"
+	proxyHost, proxyPort := proxyHostPort()
+	proxyServer := "--proxy-server=" + net.JoinHostPort(proxyHost, strconv.Itoa(proxyPort))
 
 	var cmd *exec.Cmd
 	switch browser {
@@ -252,7 +269,7 @@ func StartBrowser(browser Browser) error {
 	case Chrome:
 		cmd = exec.Command(executable,
 			"--user-data-dir="+profilePath,
-			"--proxy-server=127.0.0.1:8181",
+			proxyServer,
 			"--ignore-certificate-errors",
 			"--ignore-ssl-errors",
 			"--ignore-certificate-errors-spki-list",
@@ -263,7 +280,7 @@ func StartBrowser(browser Browser) error {
 	case Edge:
 		cmd = exec.Command(executable,
 			"--user-data-dir="+profilePath,
-			"--proxy-server=127.0.0.1:8181",
+			proxyServer,
 			"--ignore-certificate-errors",
 			"--ignore-ssl-errors",
 			"--ignore-certificate-errors-spki-list",
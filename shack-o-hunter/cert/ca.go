@@ -0,0 +1,520 @@
+package cert
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"proxy-interceptor/config"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/youmark/pkcs8"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+var (
+	// caCert and caKey are replaced by a rotation or an import while leaf
+	// certificates may be signed, hence caMu
+	caCert *x509.Certificate
+	caKey  crypto.Signer
+	caMu   sync.RWMutex
+
+	CACertPath string
+)
+
+func authority() (*x509.Certificate, crypto.Signer) {
+	caMu.RLock()
+	defer caMu.RUnlock()
+	return caCert, caKey
+}
+
+func setAuthority(cert *x509.Certificate, key crypto.Signer) {
+	caMu.Lock()
+	caCert, caKey = cert, key
+	caMu.Unlock()
+}
+
+// CACertificate returns the CA certificate, nil before InitCA
+func CACertificate() *x509.Certificate {
+	cert, _ := authority()
+	return cert
+}
+
+// CAName returns the CA's common name, under which trust stores list it
+func CAName() string {
+	if cert := CACertificate(); cert != nil {
+		return cert.Subject.CommonName
+	}
+	return "ShackoDodo Proxy CA"
+}
+
+// caPaths returns the CA files, by default next to the executable
+func caPaths() (string, string) {
+	cfg := config.GetInstance()
+	return config.ResolvePath(cfg.CACertPath, "shackododo-ca.crt"), config.ResolvePath(cfg.CAKeyPath, "shackododo-ca.key")
+}
+
+// InitCA loads the Certificate Authority, or creates it on first run
+func InitCA() error {
+	certPath, keyPath := caPaths()
+	CACertPath = certPath
+
+	if !fileExists(certPath) || !fileExists(keyPath) {
+		cert, key, err := newCA()
+		if err != nil {
+			return err
+		}
+		if err := writeCA(cert, key); err != nil {
+			return err
+		}
+		setAuthority(cert, key)
+		return nil
+	}
+
+	certData, err := os.ReadFile(certPath)
+	if err != nil {
+		return err
+	}
+	cert, err := parseCertificate(certData)
+	if err != nil {
+		return err
+	}
+	keyData, err := os.ReadFile(keyPath)
+	if err != nil {
+		return err
+	}
+	passphrase := config.GetInstance().CAKeyPassphrase
+	key, err := parseKey(keyData, passphrase)
+	if err != nil {
+		return fmt.Errorf("%s: %v", keyPath, err)
+	}
+	setAuthority(cert, key)
+
+	// Keys written by earlier versions were readable by everyone and never encrypted
+	if passphrase != "" && !bytes.Contains(keyData, []byte("ENCRYPTED")) {
+		log.Println("Chiffrement de la clé du CA avec la phrase secrète")
+		return writeKey(keyPath, key)
+	}
+	protectKey(keyPath)
+	return nil
+}
+
+// RotateCA replaces the CA with a new one. The previous files are kept with
+// an ".old" suffix and leaf certificates signed by the previous CA are dropped.
+func RotateCA() error {
+	cert, key, err := newCA()
+	if err != nil {
+		return err
+	}
+	return replaceCA(cert, key)
+}
+
+// ImportCA replaces the CA with an existing one, e.g. shared by a team.
+// data is a PKCS#12 bundle, or a certificate with its key in PEM. The
+// certificate can also be PEM or DER with the key in keyData, PEM or DER.
+// password opens a PKCS#12 bundle or an encrypted key.
+func ImportCA(data []byte, keyData []byte, password string) error {
+	cert, err := parseCertificate(data)
+	var key crypto.Signer
+	if err != nil {
+		// Neither PEM nor DER certificate: a PKCS#12 bundle
+		rawKey, leaf, _, p12Err := pkcs12.DecodeChain(data, password)
+		if p12Err != nil {
+			return fmt.Errorf("neither a certificate nor a PKCS#12 bundle: %v", p12Err)
+		}
+		if err := checkCA(leaf); err != nil {
+			return err
+		}
+		if key, err = signer(rawKey); err != nil {
+			return err
+		}
+		cert = leaf
+	} else {
+		if err := checkCA(cert); err != nil {
+			return err
+		}
+		if keyData == nil {
+			keyData = data
+		}
+		if key, err = parseKey(keyData, password); err != nil {
+			return err
+		}
+	}
+
+	if !publicKeyEqual(cert.PublicKey, key.Public()) {
+		return fmt.Errorf("the key does not match the certificate")
+	}
+	return replaceCA(cert, key)
+}
+
+// checkCA tells why a certificate cannot be used as the CA
+func checkCA(cert *x509.Certificate) error {
+	if !cert.IsCA || (cert.KeyUsage != 0 && cert.KeyUsage&x509.KeyUsageCertSign == 0) {
+		return fmt.Errorf("%s is not a CA certificate", cert.Subject.String())
+	}
+	return nil
+}
+
+// ExportCA encodes the CA certificate as "pem" or "der", or as a "p12"
+// bundle holding the key too, protected by password
+func ExportCA(format string, password string) ([]byte, error) {
+	cert, key := authority()
+	if cert == nil {
+		return nil, fmt.Errorf("CA not initialized")
+	}
+	switch format {
+	case "pem":
+		return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), nil
+	case "der":
+		return cert.Raw, nil
+	case "p12":
+		if password == "" {
+			return nil, fmt.Errorf("a password is required to export the key")
+		}
+		return pkcs12.Modern.Encode(key, cert, nil, password)
+	}
+	return nil, fmt.Errorf("unknown format %q, expected pem, der or p12", format)
+}
+
+// Permits tells whether the CA's name constraints allow it to sign for host
+func Permits(host string) bool {
+	cert := CACertificate()
+	if cert == nil {
+		return true
+	}
+
+	if ip := net.ParseIP(strings.Trim(host, "[]")); ip != nil {
+		for _, excluded := range cert.ExcludedIPRanges {
+			if excluded.Contains(ip) {
+				return false
+			}
+		}
+		if len(cert.PermittedIPRanges) == 0 {
+			return true
+		}
+		for _, permitted := range cert.PermittedIPRanges {
+			if permitted.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, excluded := range cert.ExcludedDNSDomains {
+		if matchDomain(excluded, host) {
+			return false
+		}
+	}
+	if len(cert.PermittedDNSDomains) == 0 {
+		return true
+	}
+	for _, permitted := range cert.PermittedDNSDomains {
+		if matchDomain(permitted, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchDomain applies a DNS name constraint (RFC 5280, section 4.2.1.10):
+// "example.com" covers the domain and its subdomains, ".example.com" only
+// the subdomains
+func matchDomain(constraint string, host string) bool {
+	constraint = strings.ToLower(constraint)
+	if strings.HasPrefix(constraint, ".") {
+		return strings.HasSuffix(host, constraint)
+	}
+	return host == constraint || strings.HasSuffix(host, "."+constraint)
+}
+
+// newCA generates a CA certificate with a random serial number, restricted
+// to the configured name constraints
+func newCA() (*x509.Certificate, crypto.Signer, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, err
+	}
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			Organization:  []string{"ShackoDodo Proxy"},
+			Country:       []string{"FR"},
+			Province:      []string{""},
+			Locality:      []string{"Paris"},
+			StreetAddress: []string{""},
+			PostalCode:    []string{""},
+			CommonName:    "ShackoDodo Proxy CA",
+		},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		IsCA:                  true,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		MaxPathLenZero:        false,
+		MaxPathLen:            2,
+	}
+	for _, constraint := range config.GetInstance().CANameConstraints {
+		if _, network, err := net.ParseCIDR(constraint); err == nil {
+			template.PermittedIPRanges = append(template.PermittedIPRanges, network)
+		} else {
+			template.PermittedDNSDomains = append(template.PermittedDNSDomains, constraint)
+		}
+	}
+	template.PermittedDNSDomainsCritical = len(template.PermittedDNSDomains) > 0 || len(template.PermittedIPRanges) > 0
+
+	// Self-sign the CA certificate
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+// replaceCA writes the new CA next to the current files, then swaps them.
+// The current files are kept with an ".old" suffix, and restored if the new
+// ones cannot be moved in place.
+func replaceCA(cert *x509.Certificate, key crypto.Signer) error {
+	certPath, keyPath := caPaths()
+	certData, keyData, err := encodeCA(cert, key)
+	if err != nil {
+		return err
+	}
+	certTemp, err := stageFile(certPath, certData, 0o644)
+	if err != nil {
+		return err
+	}
+	keyTemp, err := stageFile(keyPath, keyData, 0o600)
+	if err != nil {
+		os.Remove(certTemp)
+		return err
+	}
+
+	var kept, placed []string
+	restore := func() {
+		for _, path := range placed {
+			os.Remove(path)
+		}
+		for _, path := range kept {
+			os.Rename(path+".old", path)
+		}
+		os.Remove(certTemp)
+		os.Remove(keyTemp)
+	}
+	for _, path := range []string{certPath, keyPath} {
+		if fileExists(path) {
+			if err := os.Rename(path, path+".old"); err != nil {
+				restore()
+				return err
+			}
+			kept = append(kept, path)
+		}
+	}
+	for _, file := range [][2]string{{certTemp, certPath}, {keyTemp, keyPath}} {
+		if err := os.Rename(file[0], file[1]); err != nil {
+			restore()
+			return err
+		}
+		placed = append(placed, file[1])
+	}
+
+	CACertPath = certPath
+	setAuthority(cert, key)
+	ClearCertCache()
+	return nil
+}
+
+// writeCA saves the CA certificate and its key
+func writeCA(cert *x509.Certificate, key crypto.Signer) error {
+	certPath, keyPath := caPaths()
+	certData, keyData, err := encodeCA(cert, key)
+	if err != nil {
+		return err
+	}
+	if err := writeFile(certPath, certData, 0o644); err != nil {
+		return err
+	}
+	return writeFile(keyPath, keyData, 0o600)
+}
+
+// writeKey replaces the CA key file
+func writeKey(path string, key crypto.Signer) error {
+	data, err := encodeKey(key)
+	if err != nil {
+		return err
+	}
+	return writeFile(path, data, 0o600)
+}
+
+// encodeCA encodes the CA certificate and its key in PEM
+func encodeCA(cert *x509.Certificate, key crypto.Signer) ([]byte, []byte, error) {
+	keyData, err := encodeKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), keyData, nil
+}
+
+// encodeKey encodes the CA key in PKCS#8, encrypted when a passphrase is
+// configured
+func encodeKey(key crypto.Signer) ([]byte, error) {
+	if passphrase := config.GetInstance().CAKeyPassphrase; passphrase != "" {
+		der, err := pkcs8.MarshalPrivateKey(key, []byte(passphrase), nil)
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: der}), nil
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// writeFile replaces path with data, so that it is never left half written
+func writeFile(path string, data []byte, mode os.FileMode) error {
+	temp, err := stageFile(path, data, mode)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(temp, path); err != nil {
+		os.Remove(temp)
+		return err
+	}
+	return nil
+}
+
+// stageFile writes data to a temporary file next to path, with the given
+// mode, and returns its name
+func stageFile(path string, data []byte, mode os.FileMode) (string, error) {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), mode)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// protectKey makes a key file readable by its owner only. Windows has no
+// such permission bits.
+func protectKey(path string) {
+	if runtime.GOOS == "windows" {
+		return
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.Mode().Perm()&0o077 == 0 {
+		return
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		log.Printf("Avertissement: la clé du CA %s reste lisible par d'autres utilisateurs: %v", path, err)
+		return
+	}
+	log.Printf("Permissions de la clé du CA %s restreintes à 0600", path)
+}
+
+// parseCertificate reads the first certificate of PEM data, or DER data
+func parseCertificate(data []byte) (*x509.Certificate, error) {
+	for rest := data; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
+		}
+	}
+	return x509.ParseCertificate(data)
+}
+
+// parseKey reads the first private key of PEM data, or DER data, in PKCS#1,
+// SEC 1 or PKCS#8 form. An encrypted PKCS#8 key is opened with passphrase.
+func parseKey(data []byte, passphrase string) (crypto.Signer, error) {
+	for rest := data; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		switch block.Type {
+		case "ENCRYPTED PRIVATE KEY":
+			if passphrase == "" {
+				return nil, fmt.Errorf("the key is encrypted, a passphrase is required")
+			}
+			key, err := pkcs8.ParsePKCS8PrivateKey(block.Bytes, []byte(passphrase))
+			if err != nil {
+				return nil, err
+			}
+			return signer(key)
+		case "RSA PRIVATE KEY", "EC PRIVATE KEY", "PRIVATE KEY":
+			if _, encrypted := block.Headers["Proc-Type"]; encrypted {
+				return nil, fmt.Errorf("legacy encrypted PEM keys are not supported, convert the key to PKCS#8")
+			}
+			return parseDERKey(block.Bytes)
+		}
+	}
+	return parseDERKey(data)
+}
+
+func parseDERKey(der []byte) (crypto.Signer, error) {
+	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		return signer(key)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("no private key found")
+}
+
+func signer(key any) (crypto.Signer, error) {
+	s, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+	return s, nil
+}
+
+// publicKeyEqual compares the public keys of a certificate and a private key
+func publicKeyEqual(a crypto.PublicKey, b crypto.PublicKey) bool {
+	key, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && key.Equal(b)
+}
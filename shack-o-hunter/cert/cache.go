@@ -0,0 +1,152 @@
+package cert
+
+import (
+	"container/list"
+	"crypto/tls"
+	"crypto/x509"
+	"proxy-interceptor/config"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cacheEntry is a generated certificate kept in the LRU list
+type cacheEntry struct {
+	host    string
+	cert    *tls.Certificate
+	expires time.Time
+}
+
+// pendingCert lets concurrent callers wait for a single generation
+type pendingCert struct {
+	done chan struct{}
+	cert *tls.Certificate
+	err  error
+}
+
+// certCache is a bounded LRU cache of leaf certificates keyed by host
+type certCache struct {
+	mu       sync.Mutex
+	entries  map[string]*list.Element
+	order    *list.List // Front is the most recently used
+	inflight map[string]*pendingCert
+
+	// generation changes when the cache is cleared, so that certificates
+	// generated meanwhile, e.g. signed by a replaced CA, are not kept
+	generation int
+}
+
+var leafCache = &certCache{
+	entries:  make(map[string]*list.Element),
+	order:    list.New(),
+	inflight: make(map[string]*pendingCert),
+}
+
+// GenerateCertForHost returns a certificate for a specific host, reusing a
+// cached one when possible. Concurrent calls for the same host share a
+// single generation.
+func GenerateCertForHost(host string) (*tls.Certificate, error) {
+	host = strings.ToLower(host)
+	return leafCache.get(host, func() (*tls.Certificate, error) {
+		return generateCert(host)
+	})
+}
+
+// MirrorCertForHost returns a certificate for host copying the identity of
+// the upstream server's certificate. fetch is only called when no mirrored
+// certificate is cached for the host.
+func MirrorCertForHost(host string, fetch func() (*x509.Certificate, error)) (*tls.Certificate, error) {
+	host = strings.ToLower(host)
+	return leafCache.get("mirror "+host, func() (*tls.Certificate, error) {
+		upstream, err := fetch()
+		if err != nil {
+			return nil, err
+		}
+		return mirrorCert(host, upstream)
+	})
+}
+
+// InvalidCertForHost returns a self-signed certificate for host, shown to
+// clients in place of an upstream certificate that failed verification
+func InvalidCertForHost(host string) (*tls.Certificate, error) {
+	host = strings.ToLower(host)
+	return leafCache.get("invalid "+host, func() (*tls.Certificate, error) {
+		return invalidCert(host)
+	})
+}
+
+// ClearCertCache drops every cached leaf certificate, e.g. after the CA changed
+func ClearCertCache() {
+	leafCache.mu.Lock()
+	defer leafCache.mu.Unlock()
+
+	leafCache.entries = make(map[string]*list.Element)
+	leafCache.order.Init()
+	leafCache.inflight = make(map[string]*pendingCert)
+	leafCache.generation++
+}
+
+func (c *certCache) get(host string, generate func() (*tls.Certificate, error)) (*tls.Certificate, error) {
+	c.mu.Lock()
+
+	if elem, ok := c.entries[host]; ok {
+		entry := elem.Value.(*cacheEntry)
+		if time.Now().Before(entry.expires) {
+			c.order.MoveToFront(elem)
+			c.mu.Unlock()
+			return entry.cert, nil
+		}
+		c.order.Remove(elem)
+		delete(c.entries, host)
+	}
+
+	// Another goroutine is already generating this certificate
+	if pending, ok := c.inflight[host]; ok {
+		c.mu.Unlock()
+		<-pending.done
+		return pending.cert, pending.err
+	}
+
+	pending := &pendingCert{done: make(chan struct{})}
+	c.inflight[host] = pending
+	generation := c.generation
+	c.mu.Unlock()
+
+	pending.cert, pending.err = generate()
+
+	c.mu.Lock()
+	if c.inflight[host] == pending {
+		delete(c.inflight, host)
+	}
+	if pending.err == nil && generation == c.generation {
+		c.add(host, pending.cert)
+	}
+	c.mu.Unlock()
+	close(pending.done)
+
+	return pending.cert, pending.err
+}
+
+// add stores a certificate and evicts the least recently used entries.
+// The caller must hold c.mu.
+func (c *certCache) add(host string, tlsCert *tls.Certificate) {
+	cfg := config.GetInstance()
+	if cfg.CertCacheSize <= 0 {
+		return
+	}
+
+	// Never keep a certificate beyond its own validity
+	expires := time.Now().Add(time.Duration(cfg.CertCacheTTL))
+	if tlsCert.Leaf != nil && tlsCert.Leaf.NotAfter.Before(expires) {
+		expires = tlsCert.Leaf.NotAfter
+	}
+
+	elem := c.order.PushFront(&cacheEntry{host: host, cert: tlsCert, expires: expires})
+	c.entries[host] = elem
+
+	for c.order.Len() > cfg.CertCacheSize {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).host)
+	}
+}
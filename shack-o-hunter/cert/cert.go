@@ -1,186 +1,225 @@
 package cert
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
-	"encoding/pem"
 	"fmt"
 	"math/big"
 	"net"
 	"os"
-	"path/filepath"
+	"proxy-interceptor/config"
+	"sync"
 	"time"
 )
 
 var (
-	caCert     *x509.Certificate
-	caKey      *rsa.PrivateKey
-	CACertPath string
+	sharedKey     crypto.Signer
+	sharedKeyErr  error
+	sharedKeyOnce sync.Once
 )
 
-// InitCA initializes the Certificate Authority
-func InitCA() error {
-	// Get executable directory
-	exePath, err := os.Executable()
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// generateCert generates a certificate for a specific host
+func generateCert(host string) (*tls.Certificate, error) {
+	// Get the private key for the host
+	certPrivKey, err := leafKey()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	exeDir := filepath.Dir(exePath)
-
-	certPath := filepath.Join(exeDir, "shackododo-ca.crt")
-	keyPath := filepath.Join(exeDir, "shackododo-ca.key")
-	CACertPath = certPath
-
-	// Check if certificate and key already exist
-	if fileExists(certPath) && fileExists(keyPath) {
-		// Load existing certificate
-		certPEM, err := os.ReadFile(certPath)
-		if err != nil {
-			return err
-		}
-		block, _ := pem.Decode(certPEM)
-		if block == nil {
-			return fmt.Errorf("failed to decode certificate PEM")
-		}
-		caCert, err = x509.ParseCertificate(block.Bytes)
-		if err != nil {
-			return err
-		}
-
-		// Load existing private key
-		keyPEM, err := os.ReadFile(keyPath)
-		if err != nil {
-			return err
-		}
-		keyBlock, _ := pem.Decode(keyPEM)
-		if keyBlock == nil {
-			return fmt.Errorf("failed to decode key PEM")
-		}
-		caKey, err = x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
-		if err != nil {
-			return err
-		}
+	return signLeaf(hostTemplate(host, "ShackoDodo Proxy"), certPrivKey)
+}
 
-		return nil
+// invalidCert generates a self-signed certificate for host. Not being
+// issued by the CA, it makes clients warn about the connection as they
+// would about the upstream server's.
+func invalidCert(host string) (*tls.Certificate, error) {
+	certPrivKey, err := leafKey()
+	if err != nil {
+		return nil, err
 	}
+	template := hostTemplate(host, "ShackoDodo Proxy (untrusted upstream certificate)")
+	return issueLeaf(template, certPrivKey, template, certPrivKey)
+}
 
-	// Generate new CA private key
-	caKey, err = rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		return err
+// hostTemplate returns a certificate template valid for a year for host
+func hostTemplate(host string, organization string) *x509.Certificate {
+	// Parse host to check if it's an IP
+	var dnsNames []string
+	var ipAddresses []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ipAddresses = append(ipAddresses, ip)
+	} else {
+		dnsNames = append(dnsNames, host)
 	}
 
-	// Create CA certificate
-	caCert = &x509.Certificate{
-		SerialNumber: big.NewInt(2023),
+	return &x509.Certificate{
 		Subject: pkix.Name{
-			Organization:  []string{"ShackoDodo Proxy"},
-			Country:       []string{"FR"},
-			Province:      []string{""},
-			Locality:      []string{"Paris"},
-			StreetAddress: []string{""},
-			PostalCode:    []string{""},
-			CommonName:    "ShackoDodo Proxy CA",
+			Organization: []string{organization},
+			CommonName:   host,
 		},
-		NotBefore:             time.Now(),
-		NotAfter:              time.Now().AddDate(10, 0, 0),
-		IsCA:                  true,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
-		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
-		BasicConstraintsValid: true,
-		MaxPathLenZero:        false,
-		MaxPathLen:            2,
-	}
-
-	// Self-sign the CA certificate
-	caBytes, err := x509.CreateCertificate(rand.Reader, caCert, caCert, &caKey.PublicKey, caKey)
-	if err != nil {
-		return err
+		NotBefore:   time.Now(),
+		NotAfter:    time.Now().AddDate(1, 0, 0),
+		DNSNames:    dnsNames,
+		IPAddresses: ipAddresses,
 	}
+}
 
-	// Parse the certificate to get a proper x509.Certificate with Raw field set
-	caCert, err = x509.ParseCertificate(caBytes)
-	if err != nil {
-		return err
+// mirrorCert generates a certificate for host with the subject, names,
+// validity and key type of the upstream server's certificate. Names the CA
+// may not sign for are left out, and host is added to the names if they do
+// not cover it, e.g. for a client connecting by IP. Without any name left, a
+// plain certificate for host is generated.
+func mirrorCert(host string, upstream *x509.Certificate) (*tls.Certificate, error) {
+	names := permittedNames(upstream)
+	if len(names.DNSNames) == 0 && len(names.IPAddresses) == 0 {
+		return generateCert(host)
 	}
 
-	// Save CA certificate to project directory
-	certOut, err := os.Create(certPath)
+	certPrivKey, err := keyLike(upstream.PublicKey)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer certOut.Close()
-	pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: caBytes})
 
-	// Save CA private key to project directory
-	keyOut, err := os.Create(keyPath)
-	if err != nil {
-		return err
+	template := &x509.Certificate{
+		RawSubject:     upstream.RawSubject,
+		NotBefore:      upstream.NotBefore,
+		NotAfter:       upstream.NotAfter,
+		DNSNames:       names.DNSNames,
+		IPAddresses:    names.IPAddresses,
+		EmailAddresses: names.EmailAddresses,
+		URIs:           names.URIs,
 	}
-	defer keyOut.Close()
-	pem.Encode(keyOut, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(caKey)})
+	if names.VerifyHostname(host) != nil {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	return signLeaf(template, certPrivKey)
+}
 
-	return nil
+// permittedNames returns the subject alternative names of upstream allowed
+// by the CA's name constraints, since a client rejects the whole chain for a
+// single name outside them
+func permittedNames(upstream *x509.Certificate) *x509.Certificate {
+	names := &x509.Certificate{}
+	for _, name := range upstream.DNSNames {
+		if Permits(name) {
+			names.DNSNames = append(names.DNSNames, name)
+		}
+	}
+	for _, ip := range upstream.IPAddresses {
+		if Permits(ip.String()) {
+			names.IPAddresses = append(names.IPAddresses, ip)
+		}
+	}
+
+	// Constraints on these are not checked by Permits
+	ca := CACertificate()
+	if ca == nil || len(ca.PermittedEmailAddresses)+len(ca.ExcludedEmailAddresses) == 0 {
+		names.EmailAddresses = upstream.EmailAddresses
+	}
+	if ca == nil || len(ca.PermittedURIDomains)+len(ca.ExcludedURIDomains) == 0 {
+		names.URIs = upstream.URIs
+	}
+	return names
 }
 
-func fileExists(path string) bool {
-	_, err := os.Stat(path)
-	return err == nil
+// signLeaf completes a server certificate template and signs it with the CA
+func signLeaf(template *x509.Certificate, certPrivKey crypto.Signer) (*tls.Certificate, error) {
+	caCert, caKey := authority()
+	return issueLeaf(template, certPrivKey, caCert, caKey)
 }
 
-// GenerateCertForHost generates a certificate for a specific host
-func GenerateCertForHost(host string) (*tls.Certificate, error) {
-	// Generate private key for the host
-	certPrivKey, err := rsa.GenerateKey(rand.Reader, 2048)
+// issueLeaf completes a server certificate template and signs it with the
+// key of parent, which is the template itself for a self-signed certificate
+func issueLeaf(template *x509.Certificate, certPrivKey crypto.Signer, parent *x509.Certificate, parentKey crypto.Signer) (*tls.Certificate, error) {
+	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
+	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
 	if err != nil {
 		return nil, err
 	}
+	template.SerialNumber = serialNumber
 
-	// Parse host to check if it's an IP
-	var dnsNames []string
-	var ipAddresses []net.IP
-	if ip := net.ParseIP(host); ip != nil {
-		ipAddresses = append(ipAddresses, ip)
-	} else {
-		dnsNames = append(dnsNames, host)
+	// Key encipherment only makes sense for RSA key exchange
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	if _, ok := certPrivKey.(*rsa.PrivateKey); ok {
+		template.KeyUsage |= x509.KeyUsageKeyEncipherment
 	}
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	template.BasicConstraintsValid = true
 
-	// Create certificate template
-	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
-	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+	certBytes, err := x509.CreateCertificate(rand.Reader, template, parent, certPrivKey.Public(), parentKey)
 	if err != nil {
 		return nil, err
 	}
 
-	template := &x509.Certificate{
-		SerialNumber: serialNumber,
-		Subject: pkix.Name{
-			Organization: []string{"ShackoDodo Proxy"},
-			CommonName:   host,
-		},
-		NotBefore:             time.Now(),
-		NotAfter:              time.Now().AddDate(1, 0, 0),
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
-		BasicConstraintsValid: true,
-		DNSNames:              dnsNames,
-		IPAddresses:           ipAddresses,
-	}
-
-	// Create certificate signed by CA
-	certBytes, err := x509.CreateCertificate(rand.Reader, template, caCert, &certPrivKey.PublicKey, caKey)
+	leaf, err := x509.ParseCertificate(certBytes)
 	if err != nil {
 		return nil, err
 	}
 
 	// Create tls.Certificate with full chain (leaf cert + CA cert)
 	tlsCert := &tls.Certificate{
-		Certificate: [][]byte{certBytes, caCert.Raw},
+		Certificate: [][]byte{certBytes},
 		PrivateKey:  certPrivKey,
+		Leaf:        leaf,
+	}
+	if parent != template {
+		tlsCert.Certificate = append(tlsCert.Certificate, parent.Raw)
 	}
 
 	return tlsCert, nil
 }
+
+// leafKey returns the private key to use for a new leaf certificate, either
+// the shared pre-generated key or a fresh one of the configured type
+func leafKey() (crypto.Signer, error) {
+	cfg := config.GetInstance()
+	if !cfg.CertSharedKey {
+		return newKey(cfg.CertKeyType)
+	}
+
+	sharedKeyOnce.Do(func() {
+		sharedKey, sharedKeyErr = newKey(cfg.CertKeyType)
+	})
+	return sharedKey, sharedKeyErr
+}
+
+// keyLike generates a key of the same type and size as an upstream
+// certificate's, falling back to the configured leaf key
+func keyLike(pub crypto.PublicKey) (crypto.Signer, error) {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return rsa.GenerateKey(rand.Reader, pub.N.BitLen())
+	case *ecdsa.PublicKey:
+		return ecdsa.GenerateKey(pub.Curve, rand.Reader)
+	case ed25519.PublicKey:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	}
+	return leafKey()
+}
+
+func newKey(keyType string) (crypto.Signer, error) {
+	switch keyType {
+	case "ecdsa":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "rsa", "":
+		return rsa.GenerateKey(rand.Reader, 2048)
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", keyType)
+	}
+}
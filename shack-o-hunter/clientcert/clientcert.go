@@ -0,0 +1,239 @@
+package clientcert
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"proxy-interceptor/config"
+	"proxy-interceptor/scope"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// Cert is a client certificate presented to the servers whose host matches
+// its pattern, for APIs requiring mutual TLS
+type Cert struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+	Host    string `json:"host"` // Host pattern, see scope.Rule
+
+	// Either the PEM certificate chain with its private key, or a base64
+	// PKCS#12 bundle with its password. They are never listed back: saving
+	// a certificate without them keeps the current ones.
+	PEM      string `json:"pem,omitempty"`
+	PKCS12   string `json:"pkcs12,omitempty"`
+	Password string `json:"password,omitempty"`
+
+	// Read from the certificate
+	Subject  string    `json:"subject"`
+	Issuer   string    `json:"issuer"`
+	NotAfter time.Time `json:"not_after"`
+
+	tlsCert *tls.Certificate
+}
+
+var (
+	certs    []*Cert
+	certsMu  sync.RWMutex
+	filePath string
+
+	// generation changes with the list, so that connections opened with a
+	// previous certificate are not reused
+	generation int
+)
+
+// Init loads the client certificates from the configured file, by default next to the executable
+func Init() error {
+	return Load(config.ResolvePath(config.GetInstance().ClientCertsPath, "shackododo-client-certs.json"))
+}
+
+// Load reads the client certificates from the given file, which is also used
+// to persist later changes. A missing file means no certificates.
+func Load(path string) error {
+	certsMu.Lock()
+	filePath = path
+	certsMu.Unlock()
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var loaded []*Cert
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return fmt.Errorf("invalid client certificates file %s: %v", path, err)
+	}
+	for _, c := range loaded {
+		if err := c.load(); err != nil {
+			return fmt.Errorf("client certificate %s: %v", c.ID, err)
+		}
+	}
+
+	certsMu.Lock()
+	certs = loaded
+	generation++
+	certsMu.Unlock()
+	return nil
+}
+
+// List returns a copy of every client certificate, without its key material
+func List() []Cert {
+	certsMu.RLock()
+	defer certsMu.RUnlock()
+
+	list := make([]Cert, 0, len(certs))
+	for _, c := range certs {
+		listed := *c
+		listed.PEM, listed.PKCS12, listed.Password = "", "", ""
+		list = append(list, listed)
+	}
+	return list
+}
+
+// Put adds a client certificate, or replaces the one with the same ID, then
+// persists. Without PEM nor PKCS12 the replaced certificate's are kept.
+func Put(c Cert) (Cert, error) {
+	if c.ID == "" {
+		c.ID = uuid.New().String()
+	}
+	if c.Host == "" {
+		return c, fmt.Errorf("host pattern is required")
+	}
+	if err := scope.ValidateHost(c.Host); err != nil {
+		return c, err
+	}
+
+	certsMu.Lock()
+	defer certsMu.Unlock()
+
+	index := -1
+	for i, existing := range certs {
+		if existing.ID == c.ID {
+			index = i
+			if c.PEM == "" && c.PKCS12 == "" {
+				c.PEM, c.PKCS12, c.Password = existing.PEM, existing.PKCS12, existing.Password
+			}
+			break
+		}
+	}
+	if err := c.load(); err != nil {
+		return c, err
+	}
+
+	if index >= 0 {
+		certs[index] = &c
+	} else {
+		certs = append(certs, &c)
+	}
+	generation++
+
+	listed := c
+	listed.PEM, listed.PKCS12, listed.Password = "", "", ""
+	return listed, save()
+}
+
+// Delete removes a client certificate by ID, then persists
+func Delete(id string) error {
+	certsMu.Lock()
+	defer certsMu.Unlock()
+
+	for i, c := range certs {
+		if c.ID == id {
+			certs = append(certs[:i], certs[i+1:]...)
+			generation++
+			return save()
+		}
+	}
+	return fmt.Errorf("client certificate %s not found", id)
+}
+
+// For returns the first enabled certificate whose pattern matches host, or nil
+func For(host string) *Cert {
+	certsMu.RLock()
+	defer certsMu.RUnlock()
+
+	for _, c := range certs {
+		if c.Enabled && scope.MatchHost(c.Host, host) {
+			return c
+		}
+	}
+	return nil
+}
+
+// Generation returns a number that changes whenever the list does
+func Generation() int {
+	certsMu.RLock()
+	defer certsMu.RUnlock()
+	return generation
+}
+
+// Certificate returns the certificate and key to present
+func (c *Cert) Certificate() *tls.Certificate {
+	return c.tlsCert
+}
+
+// save writes the certificates to disk. The caller must hold certsMu.
+func save() error {
+	if filePath == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(certs, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filePath, data, 0o600)
+}
+
+// load parses the key material and fills the fields read from the certificate
+func (c *Cert) load() error {
+	var tlsCert tls.Certificate
+	switch {
+	case c.PEM != "" && c.PKCS12 != "":
+		return fmt.Errorf("pem and pkcs12 are exclusive")
+	case c.PEM != "":
+		// The same text holds the certificates and the key
+		var err error
+		tlsCert, err = tls.X509KeyPair([]byte(c.PEM), []byte(c.PEM))
+		if err != nil {
+			return fmt.Errorf("pem: %v", err)
+		}
+	case c.PKCS12 != "":
+		data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(c.PKCS12))
+		if err != nil {
+			return fmt.Errorf("pkcs12: invalid base64: %v", err)
+		}
+		key, leaf, chain, err := pkcs12.DecodeChain(data, c.Password)
+		if err != nil {
+			return err // Already prefixed by "pkcs12: "
+		}
+		tlsCert.PrivateKey = key
+		tlsCert.Certificate = append(tlsCert.Certificate, leaf.Raw)
+		for _, ca := range chain {
+			tlsCert.Certificate = append(tlsCert.Certificate, ca.Raw)
+		}
+	default:
+		return fmt.Errorf("pem or pkcs12 is required")
+	}
+
+	leaf, err := x509.ParseCertificate(tlsCert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	tlsCert.Leaf = leaf
+	c.Subject = leaf.Subject.String()
+	c.Issuer = leaf.Issuer.String()
+	c.NotAfter = leaf.NotAfter
+	c.tlsCert = &tlsCert
+	return nil
+}
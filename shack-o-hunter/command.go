@@ -0,0 +1,105 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"proxy-interceptor/admin"
+	"proxy-interceptor/cert"
+	"proxy-interceptor/config"
+)
+
+const caUsage = `usage:
+  shackododo [options] ca export [-format pem|der|p12] [-password secret] [-out file]
+  shackododo [options] ca import [-password secret] <certificate, PEM bundle or .p12> [key]
+  shackododo [options] ca rotate`
+
+// runCommand runs a command given after the options instead of starting
+// the proxy
+func runCommand(args []string) error {
+	if len(args) < 2 || args[0] != "ca" {
+		return fmt.Errorf("unknown command %q\n%s", args[0], caUsage)
+	}
+
+	flags := flag.NewFlagSet("ca "+args[1], flag.ContinueOnError)
+	format := flags.String("format", "pem", "export format: pem, der or p12 (with the key)")
+	password := flags.String("password", "", "password of the .p12 bundle or of the imported key")
+	out := flags.String("out", "", "exported file, standard output by default")
+	if err := flags.Parse(args[2:]); err != nil {
+		return err
+	}
+
+	switch args[1] {
+	case "export":
+		if err := cert.InitCA(); err != nil {
+			return err
+		}
+		data, err := cert.ExportCA(*format, *password)
+		if err != nil {
+			return err
+		}
+		if *out == "" {
+			_, err = os.Stdout.Write(data)
+			return err
+		}
+		// A bundle holds the private key
+		return os.WriteFile(*out, data, 0o600)
+
+	case "import":
+		if flags.NArg() < 1 || flags.NArg() > 2 {
+			return fmt.Errorf("%s", caUsage)
+		}
+		data, err := os.ReadFile(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		var keyData []byte
+		if flags.NArg() == 2 {
+			if keyData, err = os.ReadFile(flags.Arg(1)); err != nil {
+				return err
+			}
+		}
+		return replaceCA(func() error { return cert.ImportCA(data, keyData, *password) })
+
+	case "rotate":
+		return replaceCA(cert.RotateCA)
+	}
+	return fmt.Errorf("unknown command %q\n%s", "ca "+args[1], caUsage)
+}
+
+// replaceCA swaps the CA in the system trust store around replace, which
+// needs administrator privileges unless -no-privilege is set
+func replaceCA(replace func() error) error {
+	cfg := config.GetInstance()
+	if !cfg.NoPrivilege && !admin.IsAdmin() {
+		log.Println("Le remplacement du CA dans le magasin système nécessite des privilèges administrateur (ou relancez avec -no-privilege)...")
+		return admin.RequestElevation()
+	}
+
+	// The current CA may be unreadable, e.g. for a lost passphrase
+	if err := cert.InitCA(); err != nil {
+		log.Printf("Avertissement: CA actuel illisible: %v", err)
+	}
+	oldName := cert.CAName()
+	if err := replace(); err != nil {
+		return err
+	}
+	ca := cert.CACertificate()
+	log.Printf("Nouveau CA %q (numéro de série %x) enregistré dans %s", ca.Subject.CommonName, ca.SerialNumber, cert.CACertPath)
+
+	if cfg.NoPrivilege {
+		log.Println("Mode sans privilèges: installez le nouveau certificat CA dans le magasin système et les navigateurs")
+		return nil
+	}
+	if admin.IsCertInstalledInSystemStore(oldName) {
+		if err := admin.UninstallCertFromSystemStore(oldName); err != nil {
+			log.Printf("Avertissement: impossible de retirer l'ancien CA du magasin système: %v", err)
+		}
+	}
+	if err := admin.InstallCertToSystemStore(cert.CACertPath); err != nil {
+		return fmt.Errorf("impossible d'installer le nouveau CA dans le magasin système: %v", err)
+	}
+	log.Println("Nouveau certificat CA installé dans le magasin système")
+	return nil
+}
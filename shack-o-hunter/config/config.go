@@ -1,14 +1,102 @@
 package config
 
-import "sync"
+import (
+	"encoding/json"
+	"fmt"
+	"proxy-interceptor/scope"
+	"proxy-interceptor/upstream"
+	"sync"
+	"time"
+)
 
 // Config holds the application's configuration.
 type Config struct {
-	ProxyPort     int
-	WebSocketPort int
-	Pause         bool
-	FilterMozilla bool
-	mu            sync.Mutex
+	ProxyAddress     string         `json:"proxy_address"`
+	ProxyPort        int            `json:"proxy_port"`
+	SOCKSPort        int            `json:"socks_port"`      // SOCKS5/SOCKS4a listener on the proxy address, 0 disables it
+	InvisiblePorts   []int          `json:"invisible_ports"` // Listeners for clients that are not proxy-aware, e.g. [80, 443]
+	ReverseProxies   []ReverseProxy `json:"reverse_proxies"`
+	WebSocketAddress string         `json:"websocket_address"`
+	WebSocketPort    int            `json:"websocket_port"`
+	FrontendAddress  string         `json:"frontend_address"` // Empty listens on every interface
+	FrontendPort     int            `json:"frontend_port"`
+	AutoOpen         bool           `json:"auto_open"`       // Open the UI and a browser at startup
+	NoPrivilege      bool           `json:"no_privilege"`    // Run unprivileged and leave the system trust store alone
+	OnboardingHost   string         `json:"onboarding_host"` // Host answered by the proxy with the CA download page, empty disables it
+
+	// Files, empty means next to the executable
+	CACertPath      string `json:"ca_cert_path"`
+	CAKeyPath       string `json:"ca_key_path"`
+	HistoryPath     string `json:"history_path"`
+	RulesPath       string `json:"rules_path"`
+	ClientCertsPath string `json:"client_certs_path"`
+
+	Pause          bool        `json:"pause"`
+	PauseResponses bool        `json:"pause_responses"`
+	PauseWebSocket bool        `json:"pause_websocket"` // Pause WebSocket data frames
+	PauseTimeout   Duration    `json:"pause_timeout"`   // How long a paused message waits for the UI
+	FilterMozilla  bool        `json:"filter_mozilla"`
+	Scope          scope.Scope `json:"scope"`
+
+	// Outbound traffic
+	Upstream    upstream.Settings  `json:"upstream"`
+	UpstreamTLS upstream.TLSPolicy `json:"upstream_tls"` // Verification of server certificates
+
+	ForceHTTP1 bool `json:"force_http1"` // Never negotiate HTTP/2, neither with clients nor servers
+
+	// Message bodies
+	BodyMemoryLimit int    `json:"body_memory_limit"` // Larger bodies are streamed through and spilled to a temporary file
+	BodyPreviewSize int    `json:"body_preview_size"` // Bytes of a streamed body shown in the UI
+	BodyEncoding    string `json:"body_encoding"`     // "base64" or "hex" for bodies that are not valid UTF-8
+
+	// Leaf certificate generation
+	CertCacheSize int      `json:"cert_cache_size"` // Maximum number of host certificates kept in memory
+	CertCacheTTL  Duration `json:"cert_cache_ttl"`  // How long a generated certificate is reused
+	CertKeyType   string   `json:"cert_key_type"`   // "rsa" or "ecdsa" (P-256)
+	CertSharedKey bool     `json:"cert_shared_key"` // Reuse a single pre-generated key for every leaf
+	CertMirror    bool     `json:"cert_mirror"`     // Copy the upstream certificate's subject, names, validity and key type
+
+	// Root CA
+	CAKeyPassphrase   string   `json:"-"`                   // Encrypts the CA key file, from the environment or the command line only
+	CANameConstraints []string `json:"ca_name_constraints"` // Domains, e.g. "example.com", or CIDR ranges a new CA may sign for
+
+	path string // File the configuration was loaded from, if any
+	mu   sync.Mutex
+}
+
+// ReverseProxy is a listener forwarding every request to a single backend
+type ReverseProxy struct {
+	Port        int    `json:"port"`
+	Target      string `json:"target"`             // Backend base URL, e.g. "http://127.0.0.1:5000"
+	TLS         bool   `json:"tls"`                // Terminate TLS with a certificate issued by the CA
+	TLSHost     string `json:"tls_host,omitempty"` // Certificate name for clients without SNI, "localhost" by default
+	RewriteHost bool   `json:"rewrite_host"`       // Send the backend's host instead of the client's Host header
+}
+
+// Duration is a time.Duration written as "30s" in configuration files.
+// Plain numbers are read as seconds.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var seconds float64
+	if err := json.Unmarshal(data, &seconds); err == nil {
+		*d = Duration(seconds * float64(time.Second))
+		return nil
+	}
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		return fmt.Errorf("invalid duration %s", data)
+	}
+	parsed, err := time.ParseDuration(text)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q", text)
+	}
+	*d = Duration(parsed)
+	return nil
 }
 
 var (
@@ -23,16 +111,110 @@ func (c *Config) SetPause(pause bool) {
 	c.Pause = pause
 }
 
+// SetPauseResponses sets the response pause value in a thread-safe way.
+func (c *Config) SetPauseResponses(pause bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.PauseResponses = pause
+}
+
+// SetPauseWebSocket sets the WebSocket frame pause value in a thread-safe way.
+func (c *Config) SetPauseWebSocket(pause bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.PauseWebSocket = pause
+}
+
+// GetScope returns the interception scope in a thread-safe way.
+func (c *Config) GetScope() scope.Scope {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Scope
+}
+
+// SetScope validates and sets the interception scope in a thread-safe way.
+func (c *Config) SetScope(s scope.Scope) error {
+	if err := s.Validate(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Scope = s
+	return nil
+}
+
+// GetUpstream returns the upstream proxy settings in a thread-safe way.
+func (c *Config) GetUpstream() upstream.Settings {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Upstream
+}
+
+// SetUpstream validates and sets the upstream proxy settings in a thread-safe way.
+func (c *Config) SetUpstream(u upstream.Settings) error {
+	if err := u.Validate(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Upstream = u
+	return nil
+}
+
+// GetUpstreamTLS returns the server certificate policy in a thread-safe way.
+func (c *Config) GetUpstreamTLS() upstream.TLSPolicy {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.UpstreamTLS
+}
+
+// SetUpstreamTLS validates and sets the server certificate policy in a thread-safe way.
+func (c *Config) SetUpstreamTLS(p upstream.TLSPolicy) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.UpstreamTLS = p
+	return nil
+}
+
+// defaults returns a configuration with the default values
+func defaults() *Config {
+	return &Config{
+		ProxyAddress:     "127.0.0.1",
+		ProxyPort:        8181,
+		SOCKSPort:        0, // SOCKS is opt-in
+		WebSocketAddress: "127.0.0.1",
+		WebSocketPort:    8182, // Default WebSocket port
+		FrontendAddress:  "",
+		FrontendPort:     3000,
+		AutoOpen:         true,
+		OnboardingHost:   "shackododo",
+		Pause:            false,
+		PauseResponses:   false,
+		PauseTimeout:     Duration(30 * time.Second),
+		FilterMozilla:    true,
+		CertCacheSize:    1000,
+		CertCacheTTL:     Duration(24 * time.Hour),
+		CertKeyType:      "rsa",
+		CertSharedKey:    false,
+		BodyMemoryLimit:  10 << 20,
+		BodyPreviewSize:  64 << 10,
+		BodyEncoding:     "base64",
+		UpstreamTLS:      upstream.TLSPolicy{Verify: true},
+		Scope: scope.Scope{
+			// Everything is in scope until include rules are added
+			DontLog:       true,
+			DontIntercept: true,
+		},
+	}
+}
+
 // GetInstance returns the singleton instance of the Config.
 func GetInstance() *Config {
 	once.Do(func() {
-		instance = &Config{
-			// Default values
-			ProxyPort:     8181,
-			WebSocketPort: 8182, // Default WebSocket port
-			Pause:         false,
-			FilterMozilla: true,
-		}
+		instance = defaults()
 	})
 	return instance
 }
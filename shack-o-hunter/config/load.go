@@ -0,0 +1,512 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"proxy-interceptor/scope"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultFileName is the configuration file looked up next to the executable
+const DefaultFileName = "shackododo.json"
+
+// envPrefix prefixes every environment override, e.g. SHACKODODO_PROXY_PORT
+const envPrefix = "SHACKODODO_"
+
+// option is a setting that can be overridden by a flag and an environment
+// variable. The flag is named after the option, the variable after its
+// upper-cased name with dashes replaced by underscores.
+type option struct {
+	name   string
+	field  string // JSON field, used in error messages
+	usage  string
+	isBool bool
+	set    func(c *Config, value string) error
+}
+
+var options = []option{
+	{name: "proxy-address", field: "proxy_address", usage: "proxy listen address", set: func(c *Config, v string) error {
+		c.ProxyAddress = v
+		return nil
+	}},
+	{name: "proxy-port", field: "proxy_port", usage: "proxy listen port", set: func(c *Config, v string) error {
+		return setInt(&c.ProxyPort, v)
+	}},
+	{name: "socks-port", field: "socks_port", usage: "SOCKS5/SOCKS4a listen port on the proxy address, 0 to disable", set: func(c *Config, v string) error {
+		return setInt(&c.SOCKSPort, v)
+	}},
+	{name: "invisible-ports", field: "invisible_ports", usage: "comma-separated ports for invisible mode, routed by SNI and Host header (e.g. 80,443)", set: func(c *Config, v string) error {
+		c.InvisiblePorts = nil
+		for _, port := range strings.Split(v, ",") {
+			if port = strings.TrimSpace(port); port == "" {
+				continue
+			}
+			var n int
+			if err := setInt(&n, port); err != nil {
+				return err
+			}
+			c.InvisiblePorts = append(c.InvisiblePorts, n)
+		}
+		return nil
+	}},
+	{name: "reverse", field: "reverse_proxies", usage: "comma-separated reverse proxy listeners as port=target, e.g. 8080=http://127.0.0.1:5000", set: func(c *Config, v string) error {
+		c.ReverseProxies = nil
+		for _, spec := range strings.Split(v, ",") {
+			if spec = strings.TrimSpace(spec); spec == "" {
+				continue
+			}
+			port, target, found := strings.Cut(spec, "=")
+			if !found {
+				return fmt.Errorf("expected port=target, got %q", spec)
+			}
+			rp := ReverseProxy{Target: target}
+			if err := setInt(&rp.Port, port); err != nil {
+				return err
+			}
+			c.ReverseProxies = append(c.ReverseProxies, rp)
+		}
+		return nil
+	}},
+	{name: "websocket-address", field: "websocket_address", usage: "WebSocket listen address", set: func(c *Config, v string) error {
+		c.WebSocketAddress = v
+		return nil
+	}},
+	{name: "websocket-port", field: "websocket_port", usage: "WebSocket listen port", set: func(c *Config, v string) error {
+		return setInt(&c.WebSocketPort, v)
+	}},
+	{name: "ui-address", field: "frontend_address", usage: "web interface listen address (empty for every interface)", set: func(c *Config, v string) error {
+		c.FrontendAddress = v
+		return nil
+	}},
+	{name: "ui-port", field: "frontend_port", usage: "web interface listen port", set: func(c *Config, v string) error {
+		return setInt(&c.FrontendPort, v)
+	}},
+	{name: "auto-open", field: "auto_open", usage: "open the web interface in a browser at startup", isBool: true, set: func(c *Config, v string) error {
+		return setBool(&c.AutoOpen, v)
+	}},
+	{name: "no-privilege", field: "no_privilege", usage: "run without administrator privileges and skip the system CA install", isBool: true, set: func(c *Config, v string) error {
+		return setBool(&c.NoPrivilege, v)
+	}},
+	{name: "onboarding-host", field: "onboarding_host", usage: "host answered with the CA download page, e.g. http://shackododo/ (empty to disable)", set: func(c *Config, v string) error {
+		c.OnboardingHost = v
+		return nil
+	}},
+	{name: "ca-cert", field: "ca_cert_path", usage: "CA certificate file", set: func(c *Config, v string) error {
+		c.CACertPath = v
+		return nil
+	}},
+	{name: "ca-key", field: "ca_key_path", usage: "CA private key file", set: func(c *Config, v string) error {
+		c.CAKeyPath = v
+		return nil
+	}},
+	{name: "ca-key-passphrase", field: "ca_key_passphrase", usage: "passphrase encrypting the CA private key file (prefer SHACKODODO_CA_KEY_PASSPHRASE)", set: func(c *Config, v string) error {
+		c.CAKeyPassphrase = v
+		return nil
+	}},
+	{name: "ca-name-constraints", field: "ca_name_constraints", usage: "comma-separated domains or CIDR ranges a new CA may sign for", set: func(c *Config, v string) error {
+		c.CANameConstraints = splitList(v)
+		return nil
+	}},
+	{name: "history", field: "history_path", usage: "traffic history file", set: func(c *Config, v string) error {
+		c.HistoryPath = v
+		return nil
+	}},
+	{name: "rules", field: "rules_path", usage: "match-and-replace rules file", set: func(c *Config, v string) error {
+		c.RulesPath = v
+		return nil
+	}},
+	{name: "client-certs", field: "client_certs_path", usage: "client certificates file for servers requiring mutual TLS", set: func(c *Config, v string) error {
+		c.ClientCertsPath = v
+		return nil
+	}},
+	{name: "pause", field: "pause", usage: "pause requests at startup", isBool: true, set: func(c *Config, v string) error {
+		return setBool(&c.Pause, v)
+	}},
+	{name: "pause-timeout", field: "pause_timeout", usage: "how long a paused message waits for the UI, e.g. 30s", set: func(c *Config, v string) error {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", v)
+		}
+		c.PauseTimeout = Duration(d)
+		return nil
+	}},
+	{name: "filter-mozilla", field: "filter_mozilla", usage: "hide Firefox background traffic", isBool: true, set: func(c *Config, v string) error {
+		return setBool(&c.FilterMozilla, v)
+	}},
+	{name: "scope", field: "scope", usage: "comma-separated in-scope host patterns", set: func(c *Config, v string) error {
+		c.Scope.Include = nil
+		for _, host := range strings.Split(v, ",") {
+			if host = strings.TrimSpace(host); host != "" {
+				c.Scope.Include = append(c.Scope.Include, scope.Rule{Host: host})
+			}
+		}
+		return nil
+	}},
+	{name: "upstream-proxy", field: "upstream.proxy", usage: "default upstream proxy URL for outbound traffic (http, https or socks5)", set: func(c *Config, v string) error {
+		c.Upstream.Proxy = v
+		return nil
+	}},
+	{name: "upstream-bypass", field: "upstream.bypass", usage: "comma-separated host patterns reached without the upstream proxy", set: func(c *Config, v string) error {
+		c.Upstream.Bypass = splitList(v)
+		return nil
+	}},
+	{name: "tls-verify", field: "upstream_tls.verify", usage: "refuse servers whose certificate is not trusted", isBool: true, set: func(c *Config, v string) error {
+		return setBool(&c.UpstreamTLS.Verify, v)
+	}},
+	{name: "tls-ca-bundles", field: "upstream_tls.ca_bundles", usage: "comma-separated PEM files of CAs trusted besides the system roots", set: func(c *Config, v string) error {
+		c.UpstreamTLS.CABundles = splitList(v)
+		return nil
+	}},
+	{name: "tls-ignore-hosts", field: "upstream_tls.ignore_hosts", usage: "comma-separated host patterns whose certificate errors are ignored", set: func(c *Config, v string) error {
+		c.UpstreamTLS.IgnoreHosts = splitList(v)
+		return nil
+	}},
+	{name: "tls-reflect-invalid", field: "upstream_tls.reflect_invalid", usage: "show clients an invalid certificate for untrusted servers instead of refusing them", isBool: true, set: func(c *Config, v string) error {
+		return setBool(&c.UpstreamTLS.ReflectInvalid, v)
+	}},
+	{name: "force-http1", field: "force_http1", usage: "disable HTTP/2 with clients and servers", isBool: true, set: func(c *Config, v string) error {
+		return setBool(&c.ForceHTTP1, v)
+	}},
+	{name: "cert-mirror", field: "cert_mirror", usage: "mirror the upstream server certificate in generated certificates", isBool: true, set: func(c *Config, v string) error {
+		return setBool(&c.CertMirror, v)
+	}},
+	{name: "body-memory-limit", field: "body_memory_limit", usage: "size in bytes above which bodies are streamed instead of buffered", set: func(c *Config, v string) error {
+		return setInt(&c.BodyMemoryLimit, v)
+	}},
+	{name: "body-encoding", field: "body_encoding", usage: `encoding of binary bodies sent to the UI, "base64" or "hex"`, set: func(c *Config, v string) error {
+		c.BodyEncoding = v
+		return nil
+	}},
+	{name: "cert-key-type", field: "cert_key_type", usage: `leaf certificate key type, "rsa" or "ecdsa"`, set: func(c *Config, v string) error {
+		c.CertKeyType = v
+		return nil
+	}},
+}
+
+// flagValue records a flag so that it can be applied after the file and
+// the environment, whatever its position on the command line
+type flagValue struct {
+	opt    option
+	values *[]setting
+}
+
+type setting struct {
+	opt   option
+	value string
+}
+
+func (f flagValue) String() string   { return "" }
+func (f flagValue) IsBoolFlag() bool { return f.opt.isBool }
+func (f flagValue) Set(v string) error {
+	*f.values = append(*f.values, setting{opt: f.opt, value: v})
+	return nil
+}
+
+// commandArgs are the arguments following the flags
+var commandArgs []string
+
+// Args returns the command-line arguments following the flags, e.g. a
+// command such as "ca rotate"
+func Args() []string {
+	return commandArgs
+}
+
+// Load builds the configuration from, in increasing priority, the defaults,
+// the configuration file, SHACKODODO_* environment variables and the
+// command-line flags. It must be called before any use of GetInstance.
+func Load(args []string) error {
+	cfg := defaults()
+
+	flags := flag.NewFlagSet("shackododo", flag.ContinueOnError)
+	configPath := flags.String("config", "", "configuration file (default "+DefaultFileName+" next to the executable)")
+	var fromFlags []setting
+	for _, opt := range options {
+		flags.Var(flagValue{opt: opt, values: &fromFlags}, opt.name, opt.usage)
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	commandArgs = flags.Args()
+
+	// Configuration file
+	path := *configPath
+	explicit := path != ""
+	if !explicit {
+		path = os.Getenv(envPrefix + "CONFIG")
+		explicit = path != ""
+	}
+	if !explicit {
+		path = besideExecutable(DefaultFileName)
+	}
+	if err := cfg.readFile(path, explicit); err != nil {
+		return err
+	}
+	cfg.path = path
+
+	// Environment overrides
+	for _, opt := range options {
+		name := envPrefix + strings.ToUpper(strings.ReplaceAll(opt.name, "-", "_"))
+		if value, ok := os.LookupEnv(name); ok {
+			if err := opt.set(cfg, value); err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+		}
+	}
+
+	// Flags
+	for _, s := range fromFlags {
+		if err := s.opt.set(cfg, s.value); err != nil {
+			return fmt.Errorf("-%s: %v", s.opt.name, err)
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	once.Do(func() {})
+	instance = cfg
+	return nil
+}
+
+// readFile merges the JSON configuration file into c. A missing file is only
+// an error if it was explicitly requested.
+func (c *Config) readFile(path string, required bool) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) && !required {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(c); err != nil && err != io.EOF {
+		if typeErr, ok := err.(*json.UnmarshalTypeError); ok {
+			return fmt.Errorf("%s: %s: expected %s", path, typeErr.Field, typeErr.Type)
+		}
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+// Save writes the given sections, e.g. "scope", to the file the
+// configuration was loaded from, or to the default file next to the
+// executable. The rest of the file is kept as it is, so that flags and
+// environment overrides, which only apply to this run, are never persisted.
+func (c *Config) Save(sections ...string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	path := c.path
+	if path == "" {
+		path = besideExecutable(DefaultFileName)
+	}
+
+	file := make(map[string]json.RawMessage)
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(bytes.TrimSpace(data)) > 0 {
+		if err := json.Unmarshal(data, &file); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	}
+
+	data, err = json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	current := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(data, &current); err != nil {
+		return err
+	}
+	for _, section := range sections {
+		value, ok := current[section]
+		if !ok {
+			return fmt.Errorf("unknown configuration section %q", section)
+		}
+		file[section] = value
+	}
+
+	data, err = json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o600)
+}
+
+// Validate checks every setting and names the first invalid field
+func (c *Config) Validate() error {
+	type portField struct {
+		field    string
+		port     int
+		optional bool // 0 disables the listener
+	}
+	ports := []portField{
+		{"proxy_port", c.ProxyPort, false},
+		{"socks_port", c.SOCKSPort, true},
+		{"websocket_port", c.WebSocketPort, false},
+		{"frontend_port", c.FrontendPort, false},
+	}
+	for i, port := range c.InvisiblePorts {
+		ports = append(ports, portField{fmt.Sprintf("invisible_ports[%d]", i), port, false})
+	}
+	for i, rp := range c.ReverseProxies {
+		ports = append(ports, portField{fmt.Sprintf("reverse_proxies[%d].port", i), rp.Port, false})
+	}
+	used := make(map[int]string)
+	for _, p := range ports {
+		if p.optional && p.port == 0 {
+			continue
+		}
+		if p.port < 1 || p.port > 65535 {
+			return fmt.Errorf("%s: invalid port %d", p.field, p.port)
+		}
+		if other, exists := used[p.port]; exists {
+			return fmt.Errorf("%s: port %d already used by %s", p.field, p.port, other)
+		}
+		used[p.port] = p.field
+	}
+
+	addresses := []struct {
+		field    string
+		address  string
+		required bool
+	}{
+		{"proxy_address", c.ProxyAddress, true},
+		{"websocket_address", c.WebSocketAddress, true},
+		{"frontend_address", c.FrontendAddress, false},
+	}
+	for _, a := range addresses {
+		if a.address == "" {
+			if a.required {
+				return fmt.Errorf("%s: must not be empty", a.field)
+			}
+			continue
+		}
+		if strings.ContainsAny(a.address, ":/ ") && net.ParseIP(a.address) == nil {
+			return fmt.Errorf("%s: invalid address %q", a.field, a.address)
+		}
+	}
+
+	if strings.ContainsAny(c.OnboardingHost, ":/ ") {
+		return fmt.Errorf("onboarding_host: invalid host %q", c.OnboardingHost)
+	}
+
+	if (c.CACertPath == "") != (c.CAKeyPath == "") {
+		return fmt.Errorf("ca_key_path: ca_cert_path and ca_key_path must be set together")
+	}
+
+	if c.PauseTimeout <= 0 {
+		return fmt.Errorf("pause_timeout: must be positive")
+	}
+	if c.CertCacheSize < 0 {
+		return fmt.Errorf("cert_cache_size: must not be negative")
+	}
+	if c.CertCacheTTL < 0 {
+		return fmt.Errorf("cert_cache_ttl: must not be negative")
+	}
+	if c.CertKeyType != "rsa" && c.CertKeyType != "ecdsa" {
+		return fmt.Errorf("cert_key_type: must be \"rsa\" or \"ecdsa\", got %q", c.CertKeyType)
+	}
+
+	for i, constraint := range c.CANameConstraints {
+		switch {
+		case strings.Contains(constraint, "/"):
+			if _, _, err := net.ParseCIDR(constraint); err != nil {
+				return fmt.Errorf("ca_name_constraints[%d]: invalid CIDR %q", i, constraint)
+			}
+		case constraint == "" || strings.ContainsAny(constraint, "*: "):
+			return fmt.Errorf("ca_name_constraints[%d]: invalid domain %q, e.g. \"example.com\" or \".example.com\"", i, constraint)
+		}
+	}
+
+	if c.BodyMemoryLimit < 0 {
+		return fmt.Errorf("body_memory_limit: must not be negative")
+	}
+	if c.BodyPreviewSize < 0 {
+		return fmt.Errorf("body_preview_size: must not be negative")
+	}
+	if c.BodyEncoding != "base64" && c.BodyEncoding != "hex" {
+		return fmt.Errorf("body_encoding: must be \"base64\" or \"hex\", got %q", c.BodyEncoding)
+	}
+
+	for i, rp := range c.ReverseProxies {
+		u, err := url.Parse(rp.Target)
+		if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("reverse_proxies[%d].target: invalid backend URL %q", i, rp.Target)
+		}
+	}
+
+	if err := c.Upstream.Validate(); err != nil {
+		return fmt.Errorf("upstream.%v", err)
+	}
+	if err := c.UpstreamTLS.Validate(); err != nil {
+		return fmt.Errorf("upstream_tls.%v", err)
+	}
+
+	if err := c.Scope.Validate(); err != nil {
+		return fmt.Errorf("scope.%v", err)
+	}
+	return nil
+}
+
+// besideExecutable returns the path of a file in the executable's directory
+func besideExecutable(name string) string {
+	exePath, err := os.Executable()
+	if err != nil {
+		return name
+	}
+	return filepath.Join(filepath.Dir(exePath), name)
+}
+
+// ResolvePath returns path, or the default file next to the executable when
+// path is empty
+func ResolvePath(path string, defaultName string) string {
+	if path != "" {
+		return path
+	}
+	return besideExecutable(defaultName)
+}
+
+func setInt(target *int, value string) error {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("invalid integer %q", value)
+	}
+	*target = n
+	return nil
+}
+
+func setBool(target *bool, value string) error {
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return fmt.Errorf("invalid boolean %q", value)
+	}
+	*target = b
+	return nil
+}
+
+// splitList splits a comma-separated flag value, dropping empty items
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
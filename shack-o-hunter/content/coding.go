@@ -0,0 +1,92 @@
+package content
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"proxy-interceptor/config"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// codings parses a Content-Encoding header, in the order the codings were
+// applied. "identity" is dropped.
+func codings(contentEncoding string) []string {
+	var list []string
+	for _, coding := range strings.Split(contentEncoding, ",") {
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "" && coding != "identity" {
+			list = append(list, coding)
+		}
+	}
+	return list
+}
+
+// Decompress undoes a Content-Encoding: gzip, deflate, br or a list of them.
+// The result is bounded by the body memory limit so that a small compressed
+// body cannot exhaust the memory.
+func Decompress(data []byte, contentEncoding string) ([]byte, error) {
+	list := codings(contentEncoding)
+	limit := int64(config.GetInstance().BodyMemoryLimit)
+	for i := len(list) - 1; i >= 0; i-- {
+		reader, err := decompressor(list[i], data)
+		if err != nil {
+			return nil, err
+		}
+		decoded, err := io.ReadAll(io.LimitReader(reader, limit+1))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", list[i], err)
+		}
+		if int64(len(decoded)) > limit {
+			return nil, fmt.Errorf("%s: decoded body larger than %d bytes", list[i], limit)
+		}
+		data = decoded
+	}
+	return data, nil
+}
+
+// Compress applies a Content-Encoding, the reverse of Decompress
+func Compress(data []byte, contentEncoding string) ([]byte, error) {
+	for _, coding := range codings(contentEncoding) {
+		var buf bytes.Buffer
+		var writer io.WriteCloser
+		switch coding {
+		case "gzip", "x-gzip":
+			writer = gzip.NewWriter(&buf)
+		case "deflate":
+			writer = zlib.NewWriter(&buf)
+		case "br":
+			writer = brotli.NewWriter(&buf)
+		default:
+			return nil, fmt.Errorf("unsupported content encoding %q", coding)
+		}
+		if _, err := writer.Write(data); err != nil {
+			return nil, err
+		}
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+		data = buf.Bytes()
+	}
+	return data, nil
+}
+
+func decompressor(coding string, data []byte) (io.Reader, error) {
+	switch coding {
+	case "gzip", "x-gzip":
+		return gzip.NewReader(bytes.NewReader(data))
+	case "deflate":
+		// Some servers send a raw deflate stream without the zlib wrapper
+		if reader, err := zlib.NewReader(bytes.NewReader(data)); err == nil {
+			return reader, nil
+		}
+		return flate.NewReader(bytes.NewReader(data)), nil
+	case "br":
+		return brotli.NewReader(bytes.NewReader(data)), nil
+	}
+	return nil, fmt.Errorf("unsupported content encoding %q", coding)
+}
@@ -0,0 +1,142 @@
+package content
+
+import (
+	"bytes"
+	"compress/flate"
+	"proxy-interceptor/config"
+	"strings"
+	"testing"
+)
+
+func TestCompressRoundTrip(t *testing.T) {
+	bodies := map[string][]byte{
+		"empty":  {},
+		"text":   []byte(strings.Repeat("Bonjour, ShackoDodo! ", 100)),
+		"binary": {0x00, 0xff, 0x10, 0x80, 0x7f, 0x00},
+	}
+	encodings := []string{"gzip", "x-gzip", "deflate", "br", "gzip, br", "deflate,gzip", "GZIP", "identity", "", "identity, gzip"}
+
+	for _, encoding := range encodings {
+		for name, body := range bodies {
+			compressed, err := Compress(body, encoding)
+			if err != nil {
+				t.Errorf("Compress(%s, %q): %v", name, encoding, err)
+				continue
+			}
+			decoded, err := Decompress(compressed, encoding)
+			if err != nil {
+				t.Errorf("Decompress(%s, %q): %v", name, encoding, err)
+				continue
+			}
+			if !bytes.Equal(decoded, body) {
+				t.Errorf("%s with %q: got %q after a round trip", name, encoding, decoded)
+			}
+		}
+	}
+}
+
+func TestCodings(t *testing.T) {
+	tests := []struct {
+		header string
+		want   []string
+	}{
+		{"", nil},
+		{"identity", nil},
+		{"gzip", []string{"gzip"}},
+		{" Deflate , BR ", []string{"deflate", "br"}},
+		{"gzip,,identity,br", []string{"gzip", "br"}},
+	}
+	for _, tt := range tests {
+		got := codings(tt.header)
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("codings(%q) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestDecompressRawDeflate(t *testing.T) {
+	// Some servers send deflate without the zlib wrapper
+	var buf bytes.Buffer
+	writer, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+	writer.Write([]byte("raw deflate"))
+	writer.Close()
+
+	decoded, err := Decompress(buf.Bytes(), "deflate")
+	if err != nil || string(decoded) != "raw deflate" {
+		t.Errorf("Decompress = %q, %v", decoded, err)
+	}
+}
+
+func TestDecompressErrors(t *testing.T) {
+	limit := config.GetInstance().BodyMemoryLimit
+	bomb, err := Compress(make([]byte, limit+1), "gzip")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		data     []byte
+		encoding string
+	}{
+		{"unsupported", []byte("data"), "compress"},
+		{"corrupt gzip", []byte("not gzip"), "gzip"},
+		{"larger than the memory limit", bomb, "gzip"},
+	}
+	for _, tt := range tests {
+		if _, err := Decompress(tt.data, tt.encoding); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+	if _, err := Compress([]byte("data"), "compress"); err == nil {
+		t.Error("Compress with an unsupported coding: no error")
+	}
+}
+
+func TestEncodeDecode(t *testing.T) {
+	tests := []struct {
+		name         string
+		data         []byte
+		wantEncoding string
+	}{
+		{"text", []byte("héllo"), ""},
+		{"empty", []byte{}, ""},
+		{"binary", []byte{0xff, 0xfe, 0x00}, "base64"},
+		{"invalid UTF-8", []byte("caf\xe9"), "base64"},
+	}
+	for _, tt := range tests {
+		text, encoding := Encode(tt.data)
+		if encoding != tt.wantEncoding {
+			t.Errorf("%s: encoding = %q, want %q", tt.name, encoding, tt.wantEncoding)
+		}
+		decoded, err := Decode(text, encoding)
+		if err != nil || !bytes.Equal(decoded, tt.data) {
+			t.Errorf("%s: Decode = %q, %v", tt.name, decoded, err)
+		}
+	}
+
+	if _, err := Decode("abc", "rot13"); err == nil {
+		t.Error("Decode with an unknown encoding: no error")
+	}
+}
+
+func TestPreview(t *testing.T) {
+	tests := []struct {
+		name          string
+		data          string
+		max           int
+		wantText      string
+		wantTruncated bool
+	}{
+		{"short", "hello", 10, "hello", false},
+		{"exact", "hello", 5, "hello", false},
+		{"cut", "hello world", 5, "hello", true},
+		{"cut inside a character", "aé", 2, "a", true},
+	}
+	for _, tt := range tests {
+		text, encoding, truncated := Preview([]byte(tt.data), tt.max)
+		if text != tt.wantText || encoding != "" || truncated != tt.wantTruncated {
+			t.Errorf("%s: Preview = %q, %q, %v, want %q, \"\", %v", tt.name, text, encoding, truncated, tt.wantText, tt.wantTruncated)
+		}
+	}
+}
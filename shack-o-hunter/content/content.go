@@ -0,0 +1,112 @@
+package content
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"proxy-interceptor/config"
+	"unicode/utf8"
+)
+
+// Encode returns a body as JSON-safe text: unchanged when it is valid UTF-8,
+// otherwise in the configured encoding. The returned encoding is empty for
+// plain text, "base64" or "hex" otherwise.
+func Encode(data []byte) (string, string) {
+	if utf8.Valid(data) {
+		return string(data), ""
+	}
+	if config.GetInstance().BodyEncoding == "hex" {
+		return hex.EncodeToString(data), "hex"
+	}
+	return base64.StdEncoding.EncodeToString(data), "base64"
+}
+
+// Decode reverses Encode
+func Decode(text string, encoding string) ([]byte, error) {
+	switch encoding {
+	case "":
+		return []byte(text), nil
+	case "base64":
+		return base64.StdEncoding.DecodeString(text)
+	case "hex":
+		return hex.DecodeString(text)
+	}
+	return nil, fmt.Errorf("unknown body encoding %q", encoding)
+}
+
+// Preview encodes at most max bytes of data. A multi-byte character cut by
+// the limit is dropped so that a text body stays text.
+func Preview(data []byte, max int) (text string, encoding string, truncated bool) {
+	if len(data) <= max {
+		text, encoding = Encode(data)
+		return text, encoding, false
+	}
+	cut := data[:max]
+	for i := 0; i < utf8.UTFMax-1 && len(cut) > 0 && !utf8.Valid(cut); i++ {
+		cut = cut[:len(cut)-1]
+	}
+	if !utf8.Valid(cut) {
+		cut = data[:max]
+	}
+	text, encoding = Encode(cut)
+	return text, encoding, true
+}
+
+// Recorder keeps a copy of a streamed body: its first bytes in memory and
+// the whole body in a temporary file. Write never fails so that a full disk
+// does not interrupt the transfer it is attached to.
+type Recorder struct {
+	file     *os.File
+	head     []byte
+	headSize int
+	size     int64
+	err      error
+}
+
+// NewRecorder creates the temporary file, keeping headSize bytes in memory
+func NewRecorder(headSize int) (*Recorder, error) {
+	file, err := os.CreateTemp("", "shackododo-body-*")
+	if err != nil {
+		return nil, err
+	}
+	return &Recorder{file: file, headSize: headSize}, nil
+}
+
+func (r *Recorder) Write(p []byte) (int, error) {
+	if room := r.headSize - len(r.head); room > 0 {
+		if room > len(p) {
+			room = len(p)
+		}
+		r.head = append(r.head, p[:room]...)
+	}
+	r.size += int64(len(p))
+	if r.err == nil {
+		_, r.err = r.file.Write(p)
+	}
+	return len(p), nil
+}
+
+// Close closes the file and reports a write error, if any
+func (r *Recorder) Close() error {
+	err := r.file.Close()
+	if r.err != nil {
+		return r.err
+	}
+	return err
+}
+
+// Head returns the first bytes of the body
+func (r *Recorder) Head() []byte {
+	return r.head
+}
+
+// Size returns the number of bytes written
+func (r *Recorder) Size() int64 {
+	return r.size
+}
+
+// Path returns the temporary file holding the body
+func (r *Recorder) Path() string {
+	return r.file.Name()
+}
@@ -0,0 +1,431 @@
+package har
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"proxy-interceptor/content"
+	"proxy-interceptor/history"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// HAR 1.2 structures, see http://www.softwareishard.com/blog/har-12-spec/
+
+type HAR struct {
+	Log Log `json:"log"`
+}
+
+type Log struct {
+	Version string  `json:"version"`
+	Creator Creator `json:"creator"`
+	Entries []Entry `json:"entries"`
+}
+
+type Creator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type Entry struct {
+	StartedDateTime string   `json:"startedDateTime"`
+	Time            float64  `json:"time"`
+	Request         Request  `json:"request"`
+	Response        Response `json:"response"`
+	Cache           struct{} `json:"cache"`
+	Timings         Timings  `json:"timings"`
+	ID              string   `json:"_id,omitempty"`
+	Status          string   `json:"_status,omitempty"` // Interception status of the request
+	Error           string   `json:"_error,omitempty"`
+
+	// WebSocket frames, as exported by Chrome
+	WebSocketMessages []WebSocketMessage `json:"_webSocketMessages,omitempty"`
+}
+
+type WebSocketMessage struct {
+	Type     string  `json:"type"` // "send", "receive"
+	Time     float64 `json:"time"` // Seconds since the epoch
+	Opcode   int     `json:"opcode"`
+	Data     string  `json:"data"`
+	Encoding string  `json:"_encoding,omitempty"` // "base64" for binary payloads
+}
+
+type Request struct {
+	Method      string      `json:"method"`
+	URL         string      `json:"url"`
+	HTTPVersion string      `json:"httpVersion"`
+	Cookies     []Cookie    `json:"cookies"`
+	Headers     []NameValue `json:"headers"`
+	QueryString []NameValue `json:"queryString"`
+	PostData    *PostData   `json:"postData,omitempty"`
+	HeadersSize int         `json:"headersSize"`
+	BodySize    int         `json:"bodySize"`
+}
+
+type Response struct {
+	Status      int         `json:"status"`
+	StatusText  string      `json:"statusText"`
+	HTTPVersion string      `json:"httpVersion"`
+	Cookies     []Cookie    `json:"cookies"`
+	Headers     []NameValue `json:"headers"`
+	Content     Content     `json:"content"`
+	RedirectURL string      `json:"redirectURL"`
+	HeadersSize int         `json:"headersSize"`
+	BodySize    int         `json:"bodySize"`
+}
+
+type Cookie struct {
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+	Path     string `json:"path,omitempty"`
+	Domain   string `json:"domain,omitempty"`
+	Expires  string `json:"expires,omitempty"`
+	HTTPOnly bool   `json:"httpOnly,omitempty"`
+	Secure   bool   `json:"secure,omitempty"`
+}
+
+type NameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type PostData struct {
+	MimeType string      `json:"mimeType"`
+	Params   []NameValue `json:"params,omitempty"`
+	Text     string      `json:"text"`
+	Encoding string      `json:"_encoding,omitempty"` // "base64" for binary bodies, like content.encoding
+	Comment  string      `json:"comment,omitempty"`
+}
+
+type Content struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type Timings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
+
+// Export converts history entries into a HAR 1.2 document
+func Export(entries []history.Entry) HAR {
+	doc := HAR{Log: Log{
+		Version: "1.2",
+		Creator: Creator{Name: "ShackoDodo", Version: "1.0"},
+		Entries: make([]Entry, 0, len(entries)),
+	}}
+
+	for _, e := range entries {
+		doc.Log.Entries = append(doc.Log.Entries, exportEntry(e))
+	}
+	return doc
+}
+
+func exportEntry(e history.Entry) Entry {
+	requestHeader := http.Header(e.RequestHeaders)
+	responseHeader := http.Header(e.ResponseHeaders)
+
+	entry := Entry{
+		StartedDateTime: e.StartedAt.Format(time.RFC3339Nano),
+		Time:            e.Timings.Blocked + e.Timings.Send + e.Timings.Wait + e.Timings.Receive,
+		Timings: Timings{
+			Blocked: e.Timings.Blocked,
+			DNS:     -1,
+			Connect: -1,
+			Send:    e.Timings.Send,
+			Wait:    e.Timings.Wait,
+			Receive: e.Timings.Receive,
+			SSL:     -1,
+		},
+		ID:     e.ID,
+		Status: e.Status,
+		Error:  e.Error,
+	}
+
+	entry.Request = Request{
+		Method:      e.Method,
+		URL:         e.URL,
+		HTTPVersion: httpVersion(e.ClientProtocol),
+		Cookies:     requestCookies(requestHeader),
+		Headers:     nameValues(requestHeader),
+		QueryString: []NameValue{},
+		HeadersSize: -1,
+		BodySize:    wireSize(e.RequestBody, e.RequestBodyInfo),
+	}
+	if u, err := url.Parse(e.URL); err == nil {
+		entry.Request.QueryString = valuesToNameValues(u.Query())
+	}
+	if e.RequestBody != "" {
+		mimeType := requestHeader.Get("Content-Type")
+		entry.Request.PostData = &PostData{MimeType: mimeType, Comment: truncation(e.RequestBodyInfo)}
+		entry.Request.PostData.Text, entry.Request.PostData.Encoding = harText(e.RequestBody, e.RequestBodyInfo)
+		if entry.Request.PostData.Encoding == "" && e.RequestBodyInfo.File == "" && strings.HasPrefix(mimeType, "application/x-www-form-urlencoded") {
+			if form, err := url.ParseQuery(e.RequestBody); err == nil {
+				entry.Request.PostData.Params = valuesToNameValues(form)
+			}
+		}
+	}
+
+	entry.Response = Response{
+		Status:      e.StatusCode,
+		StatusText:  http.StatusText(e.StatusCode),
+		HTTPVersion: httpVersion(e.Protocol),
+		Cookies:     responseCookies(responseHeader),
+		Headers:     nameValues(responseHeader),
+		Content: Content{
+			Size:     bodySize(e.ResponseBody, e.ResponseBodyInfo),
+			MimeType: e.ContentType,
+			Comment:  truncation(e.ResponseBodyInfo),
+		},
+		RedirectURL: responseHeader.Get("Location"),
+		HeadersSize: -1,
+		BodySize:    wireSize(e.ResponseBody, e.ResponseBodyInfo),
+	}
+	entry.Response.Content.Text, entry.Response.Content.Encoding = harText(e.ResponseBody, e.ResponseBodyInfo)
+
+	for _, f := range e.Frames {
+		message := WebSocketMessage{
+			Type:     "receive",
+			Time:     float64(f.Time.UnixNano()) / float64(time.Second),
+			Opcode:   f.Opcode,
+			Data:     f.Payload,
+			Encoding: f.Encoding,
+		}
+		if f.Direction == "client" {
+			message.Type = "send"
+		}
+		entry.WebSocketMessages = append(entry.WebSocketMessages, message)
+	}
+
+	return entry
+}
+
+// ImportHAR converts a HAR document into history entries. Entries get a new
+// ID so that importing the same file twice does not overwrite anything.
+func ImportHAR(doc HAR) ([]history.Entry, error) {
+	entries := make([]history.Entry, 0, len(doc.Log.Entries))
+	for i, e := range doc.Log.Entries {
+		entry, err := importEntry(e)
+		if err != nil {
+			return nil, fmt.Errorf("entry %d: %v", i, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func importEntry(e Entry) (history.Entry, error) {
+	startedAt, err := time.Parse(time.RFC3339Nano, e.StartedDateTime)
+	if err != nil {
+		return history.Entry{}, fmt.Errorf("invalid startedDateTime %q", e.StartedDateTime)
+	}
+
+	u, err := url.Parse(e.Request.URL)
+	if err != nil {
+		return history.Entry{}, fmt.Errorf("invalid url %q", e.Request.URL)
+	}
+
+	entry := history.Entry{
+		ID:              uuid.New().String(),
+		StartedAt:       startedAt,
+		Method:          e.Request.Method,
+		URL:             e.Request.URL,
+		Host:            u.Hostname(),
+		ClientProtocol:  e.Request.HTTPVersion,
+		Protocol:        e.Response.HTTPVersion,
+		RequestHeaders:  headerFromNameValues(e.Request.Headers),
+		Status:          "imported",
+		StatusCode:      e.Response.Status,
+		ResponseHeaders: headerFromNameValues(e.Response.Headers),
+		ContentType:     e.Response.Content.MimeType,
+		Timings: history.Timings{
+			Blocked: positive(e.Timings.Blocked),
+			Send:    positive(e.Timings.Send),
+			Wait:    positive(e.Timings.Wait),
+			Receive: positive(e.Timings.Receive),
+		},
+		Error: e.Error,
+	}
+
+	if e.Request.PostData != nil {
+		text := e.Request.PostData.Text
+		if text == "" && len(e.Request.PostData.Params) > 0 {
+			form := url.Values{}
+			for _, p := range e.Request.PostData.Params {
+				form.Add(p.Name, p.Value)
+			}
+			text = form.Encode()
+		}
+		body, err := decodeText(text, e.Request.PostData.Encoding)
+		if err != nil {
+			return history.Entry{}, fmt.Errorf("request postData: %v", err)
+		}
+		entry.SetRequestBody(body)
+	}
+
+	body, err := decodeText(e.Response.Content.Text, e.Response.Content.Encoding)
+	if err != nil {
+		return history.Entry{}, fmt.Errorf("response content: %v", err)
+	}
+	entry.SetResponseBody(body)
+
+	for _, m := range e.WebSocketMessages {
+		frame := history.Frame{
+			ID:        uuid.New().String(),
+			Time:      time.Unix(0, int64(m.Time*float64(time.Second))),
+			Direction: "server",
+			Opcode:    m.Opcode,
+			Fin:       true,
+			Payload:   m.Data,
+			Encoding:  m.Encoding,
+			Status:    "imported",
+		}
+		if m.Type == "send" {
+			frame.Direction = "client"
+		}
+		// Chrome sends binary messages in base64 without saying so
+		if m.Opcode == 2 {
+			frame.Encoding = "base64"
+		}
+		entry.Frames = append(entry.Frames, frame)
+	}
+
+	return entry, nil
+}
+
+// harText converts a recorded body to HAR text, where the only encoding is base64
+func harText(text string, info history.BodyInfo) (string, string) {
+	if info.Encoding == "" || info.Encoding == "base64" {
+		return text, info.Encoding
+	}
+	data, err := content.Decode(text, info.Encoding)
+	if err != nil {
+		return text, info.Encoding
+	}
+	return base64.StdEncoding.EncodeToString(data), "base64"
+}
+
+// decodeText reverses harText
+func decodeText(text string, encoding string) ([]byte, error) {
+	if encoding != "" && encoding != "base64" {
+		return nil, fmt.Errorf("unsupported encoding %q", encoding)
+	}
+	data, err := content.Decode(text, encoding)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s text: %v", encoding, err)
+	}
+	return data, nil
+}
+
+// bodySize is the whole body size, which a streamed body only has a preview of
+func bodySize(text string, info history.BodyInfo) int {
+	if info.Size == 0 {
+		// Recorded before sizes were stored
+		return len(text)
+	}
+	return int(info.Size)
+}
+
+// wireSize is the size of a body as transferred, compressed if it was
+func wireSize(text string, info history.BodyInfo) int {
+	if raw, err := base64.StdEncoding.DecodeString(info.Raw); err == nil && info.Raw != "" {
+		return len(raw)
+	}
+	return bodySize(text, info)
+}
+
+// truncation notes that a streamed body is exported as its preview only,
+// which keeps a large capture from being held in memory
+func truncation(info history.BodyInfo) string {
+	if info.File == "" {
+		return ""
+	}
+	return fmt.Sprintf("truncated: preview of a %d bytes body", info.Size)
+}
+
+// httpVersion defaults to HTTP/1.1 for entries recorded without a protocol
+func httpVersion(protocol string) string {
+	if protocol == "" {
+		return "HTTP/1.1"
+	}
+	return protocol
+}
+
+func nameValues(header http.Header) []NameValue {
+	list := []NameValue{}
+	for name, values := range header {
+		for _, value := range values {
+			list = append(list, NameValue{Name: name, Value: value})
+		}
+	}
+	return list
+}
+
+func valuesToNameValues(values url.Values) []NameValue {
+	list := []NameValue{}
+	for name, vals := range values {
+		for _, value := range vals {
+			list = append(list, NameValue{Name: name, Value: value})
+		}
+	}
+	return list
+}
+
+func headerFromNameValues(list []NameValue) map[string][]string {
+	header := http.Header{}
+	for _, nv := range list {
+		// HTTP/2 pseudo headers are not real headers
+		if strings.HasPrefix(nv.Name, ":") {
+			continue
+		}
+		header.Add(nv.Name, nv.Value)
+	}
+	return header
+}
+
+func requestCookies(header http.Header) []Cookie {
+	req := http.Request{Header: header}
+	cookies := []Cookie{}
+	for _, c := range req.Cookies() {
+		cookies = append(cookies, Cookie{Name: c.Name, Value: c.Value})
+	}
+	return cookies
+}
+
+func responseCookies(header http.Header) []Cookie {
+	resp := http.Response{Header: header}
+	cookies := []Cookie{}
+	for _, c := range resp.Cookies() {
+		cookie := Cookie{
+			Name:     c.Name,
+			Value:    c.Value,
+			Path:     c.Path,
+			Domain:   c.Domain,
+			HTTPOnly: c.HttpOnly,
+			Secure:   c.Secure,
+		}
+		if !c.Expires.IsZero() {
+			cookie.Expires = c.Expires.Format(time.RFC3339)
+		}
+		cookies = append(cookies, cookie)
+	}
+	return cookies
+}
+
+func positive(ms float64) float64 {
+	if ms < 0 {
+		return 0
+	}
+	return ms
+}
@@ -0,0 +1,654 @@
+package history
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"proxy-interceptor/config"
+	"proxy-interceptor/content"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Timings holds the duration of each phase of an exchange, in milliseconds
+type Timings struct {
+	Blocked float64 `json:"blocked"` // Time spent paused in the interception UI
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// Entry is a recorded request/response pair
+type Entry struct {
+	ID               string              `json:"id"`
+	StartedAt        time.Time           `json:"started_at"`
+	Method           string              `json:"method"`
+	URL              string              `json:"url"`
+	Host             string              `json:"host"`
+	ClientProtocol   string              `json:"client_protocol,omitempty"` // Between the client and the proxy, e.g. "HTTP/2.0"
+	Protocol         string              `json:"protocol,omitempty"`        // Between the proxy and the server
+	RequestHeaders   map[string][]string `json:"request_headers"`
+	RequestBody      string              `json:"request_body"`
+	RequestBodyInfo  BodyInfo            `json:"request_body_info"`
+	Status           string              `json:"status"` // "pending", "passthrough", "sent", "dropped"
+	StatusCode       int                 `json:"status_code,omitempty"`
+	ResponseHeaders  map[string][]string `json:"response_headers,omitempty"`
+	ResponseBody     string              `json:"response_body,omitempty"`
+	ResponseBodyInfo BodyInfo            `json:"response_body_info"`
+	ContentType      string              `json:"content_type,omitempty"`
+	UpstreamTLS      *TLSInfo            `json:"upstream_tls,omitempty"` // Connection to an HTTPS server
+	ClientCert       string              `json:"client_cert,omitempty"`  // Name of the client certificate presented to the server
+	Timings          Timings             `json:"timings"`
+	Error            string              `json:"error,omitempty"`
+	Frames           []Frame             `json:"frames,omitempty"` // WebSocket frames after an upgrade
+}
+
+// TLSInfo describes the TLS connection to the server and the certificate
+// chain it presented, leaf first
+type TLSInfo struct {
+	Version     string     `json:"version"` // e.g. "TLS 1.3"
+	CipherSuite string     `json:"cipher_suite"`
+	ServerName  string     `json:"server_name,omitempty"`
+	Chain       []CertInfo `json:"chain"`
+	Verified    bool       `json:"verified"`               // Against the system roots and CA bundles, for the requested host
+	VerifyError string     `json:"verify_error,omitempty"` // Why the chain is not trusted
+	Ignored     bool       `json:"ignored,omitempty"`      // The error was ignored for this host
+	Reflected   bool       `json:"reflected,omitempty"`    // The client accepted an invalid certificate in its place
+}
+
+// CertInfo is a certificate of a server's chain
+type CertInfo struct {
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	SHA256    string    `json:"sha256"` // Fingerprint of the DER certificate, in hex
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	DNSNames  []string  `json:"dns_names,omitempty"`
+}
+
+// BodyInfo describes how a body is stored. Bodies larger than the memory
+// limit are streamed: the entry then only holds a preview and the whole body
+// is in File. Compressed bodies are stored decoded, along with the raw bytes.
+type BodyInfo struct {
+	Encoding        string `json:"encoding,omitempty"` // "base64" or "hex" for bodies that are not UTF-8
+	Size            int64  `json:"size"`
+	File            string `json:"file,omitempty"`
+	ContentEncoding string `json:"content_encoding,omitempty"` // The body was decoded from, e.g. "gzip"
+	Raw             string `json:"raw,omitempty"`              // Bytes on the wire in base64, for decoded bodies
+}
+
+// SetRaw records the bytes on the wire of a body decoded from contentEncoding
+func (b *BodyInfo) SetRaw(raw []byte, contentEncoding string) {
+	b.ContentEncoding = contentEncoding
+	b.Raw = base64.StdEncoding.EncodeToString(raw)
+}
+
+// SetRequestBody records a buffered request body
+func (e *Entry) SetRequestBody(data []byte) {
+	e.RequestBody, e.RequestBodyInfo = encodeBody(data)
+}
+
+// SetResponseBody records a buffered response body
+func (e *Entry) SetResponseBody(data []byte) {
+	e.ResponseBody, e.ResponseBodyInfo = encodeBody(data)
+}
+
+// SetStreamedRequestBody records a request body copied by a recorder
+func (e *Entry) SetStreamedRequestBody(r *content.Recorder) {
+	e.RequestBody, e.RequestBodyInfo = streamedBody(r)
+}
+
+// SetStreamedResponseBody records a response body copied by a recorder
+func (e *Entry) SetStreamedResponseBody(r *content.Recorder) {
+	e.ResponseBody, e.ResponseBodyInfo = streamedBody(r)
+}
+
+// RequestBodyBytes returns the whole request body
+func (e Entry) RequestBodyBytes() ([]byte, error) {
+	return e.RequestBodyInfo.bytes(e.RequestBody)
+}
+
+// ResponseBodyBytes returns the whole response body
+func (e Entry) ResponseBodyBytes() ([]byte, error) {
+	return e.ResponseBodyInfo.bytes(e.ResponseBody)
+}
+
+// RawRequestBodyBytes returns the request body as it was sent, still
+// compressed if it was
+func (e Entry) RawRequestBodyBytes() ([]byte, error) {
+	if e.RequestBodyInfo.Raw != "" {
+		return base64.StdEncoding.DecodeString(e.RequestBodyInfo.Raw)
+	}
+	return e.RequestBodyBytes()
+}
+
+func encodeBody(data []byte) (string, BodyInfo) {
+	text, encoding := content.Encode(data)
+	return text, BodyInfo{Encoding: encoding, Size: int64(len(data))}
+}
+
+func streamedBody(r *content.Recorder) (string, BodyInfo) {
+	text, encoding, _ := content.Preview(r.Head(), config.GetInstance().BodyPreviewSize)
+	return text, BodyInfo{Encoding: encoding, Size: r.Size(), File: r.Path()}
+}
+
+func (b BodyInfo) bytes(text string) ([]byte, error) {
+	if b.File != "" {
+		return os.ReadFile(b.File)
+	}
+	return content.Decode(text, b.Encoding)
+}
+
+// Frame is a WebSocket frame relayed after an upgrade
+type Frame struct {
+	ID        string    `json:"id"`
+	Time      time.Time `json:"time"`
+	Direction string    `json:"direction"` // "client" (sent to the server), "server" (sent to the client)
+	Opcode    int       `json:"opcode"`    // 0 continuation, 1 text, 2 binary, 8 close, 9 ping, 10 pong
+	Fin       bool      `json:"fin"`
+	Payload   string    `json:"payload"`
+	Encoding  string    `json:"encoding,omitempty"` // "base64" for binary payloads
+	Status    string    `json:"status"`             // "passthrough", "sent", "dropped", "imported"
+}
+
+// frameLine is how a frame is appended to the file, after its entry
+type frameLine struct {
+	EntryID string `json:"entry_id"`
+	Frame   Frame  `json:"frame"`
+}
+
+// Filter selects entries returned by Query. Zero values match everything.
+type Filter struct {
+	Host        string    `json:"host"`         // Case-insensitive substring
+	Method      string    `json:"method"`       // Exact, case-insensitive
+	Status      string    `json:"status"`       // Interception status
+	StatusCode  int       `json:"status_code"`  // HTTP status code
+	ContentType string    `json:"content_type"` // Case-insensitive substring
+	Since       time.Time `json:"since"`
+	Until       time.Time `json:"until"`
+	Offset      int       `json:"offset"`
+	Limit       int       `json:"limit"`
+}
+
+// Page is a slice of the history matching a Filter, newest first
+type Page struct {
+	Total   int     `json:"total"`
+	Offset  int     `json:"offset"`
+	Entries []Entry `json:"entries"`
+}
+
+const (
+	defaultLimit = 100
+	maxLimit     = 1000
+)
+
+// store is an append-only JSON lines file. Updating an entry appends a new
+// line with the same ID; the last line wins when the file is loaded.
+// WebSocket frames are appended as separate lines referring to their entry.
+// Only the metadata of the entries is kept in memory: bodies and frames are
+// read back from the file when an entry is returned.
+type store struct {
+	mu      sync.RWMutex
+	file    *os.File
+	path    string
+	size    int64 // Of the file, where the next line is appended
+	entries map[string]*record
+	order   []string // IDs in insertion order
+	lines   int      // Lines in the file, to decide when to compact
+}
+
+// record locates an entry in the file
+type record struct {
+	entry  Entry  // Without bodies nor frames, unless the entry is not in the file
+	line   span   // Latest version of the entry, empty if it could not be written
+	frames []span // Lines holding its frames: frame lines, or an entry line with frames
+}
+
+// span is a line of the file, newline included
+type span struct {
+	offset int64
+	length int
+}
+
+var db = &store{entries: make(map[string]*record)}
+
+// Init opens the configured history file, by default next to the
+// executable, loading previous entries
+func Init() error {
+	return Open(config.ResolvePath(config.GetInstance().HistoryPath, "shackododo-history.jsonl"))
+}
+
+// Open loads the history from the given file and appends new entries to it
+func Open(path string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.file != nil {
+		db.file.Close()
+		db.file = nil
+	}
+	db.path = path
+	db.size = 0
+	db.entries = make(map[string]*record)
+	db.order = nil
+	db.lines = 0
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	db.file = file
+	if err := db.load(); err != nil {
+		db.file.Close()
+		db.file = nil
+		return err
+	}
+
+	// Rewrite the file when most lines are superseded updates
+	if db.lines > 2*len(db.order) {
+		if err := db.compact(); err != nil {
+			log.Printf("Avertissement: compaction de l'historique impossible: %v", err)
+		}
+	}
+	return nil
+}
+
+func (s *store) load() error {
+	reader := bufio.NewReaderSize(s.file, 64*1024)
+	for {
+		data, err := reader.ReadBytes('\n')
+		line := span{offset: s.size, length: len(data)}
+		s.size += int64(len(data))
+		if len(data) > 0 {
+			s.loadLine(data, line)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// loadLine indexes a line of the file read at the given place
+func (s *store) loadLine(data []byte, line span) {
+	var entry Entry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		// A partially written last line is not fatal
+		return
+	}
+	if entry.ID == "" {
+		var frame frameLine
+		if json.Unmarshal(data, &frame) == nil {
+			if r, exists := s.entries[frame.EntryID]; exists {
+				r.frames = append(r.frames, line)
+				s.lines++
+			}
+		}
+		return
+	}
+	s.lines++
+	s.index(&entry, line)
+}
+
+// index records that line holds the latest version of entry
+func (s *store) index(entry *Entry, line span) {
+	r, exists := s.entries[entry.ID]
+	if !exists {
+		r = &record{}
+		s.entries[entry.ID] = r
+		s.order = append(s.order, entry.ID)
+	}
+	if entry.Frames != nil {
+		// The entry comes with its frames, replacing any earlier ones
+		r.frames = []span{line}
+	}
+	r.entry = metadata(*entry)
+	r.line = line
+}
+
+// metadata strips the parts of an entry read back from the file
+func metadata(entry Entry) Entry {
+	entry.RequestBody = ""
+	entry.RequestBodyInfo.Raw = ""
+	entry.ResponseBody = ""
+	entry.ResponseBodyInfo.Raw = ""
+	entry.Frames = nil
+	return entry
+}
+
+// read returns the whole entry of a record. The caller must hold s.mu.
+func (s *store) read(r *record) (Entry, error) {
+	entry := r.entry
+	if r.line.length > 0 {
+		data, err := s.readSpan(r.line)
+		if err != nil {
+			return r.entry, err
+		}
+		entry = Entry{}
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return r.entry, err
+		}
+		entry.Frames = nil
+	}
+
+	for _, line := range r.frames {
+		data, err := s.readSpan(line)
+		if err != nil {
+			return entry, err
+		}
+		// Either a frame line or an entry line with its frames
+		var frames struct {
+			Frame  *Frame  `json:"frame"`
+			Frames []Frame `json:"frames"`
+		}
+		if err := json.Unmarshal(data, &frames); err != nil {
+			return entry, err
+		}
+		entry.Frames = append(entry.Frames, frames.Frames...)
+		if frames.Frame != nil {
+			entry.Frames = append(entry.Frames, *frames.Frame)
+		}
+	}
+	return entry, nil
+}
+
+func (s *store) readSpan(line span) ([]byte, error) {
+	if s.file == nil {
+		return nil, fmt.Errorf("history file closed")
+	}
+	data := make([]byte, line.length)
+	if _, err := s.file.ReadAt(data, line.offset); err != nil {
+		return nil, fmt.Errorf("read history: %v", err)
+	}
+	return data, nil
+}
+
+// readEntry returns what could be read of an entry, logging errors
+func (s *store) readEntry(r *record) Entry {
+	entry, err := s.read(r)
+	if err != nil {
+		log.Printf("Erreur lecture historique %s: %v", r.entry.ID, err)
+	}
+	return entry
+}
+
+// append writes a line at the end of the file. The caller must hold s.mu.
+func (s *store) append(data []byte) (span, error) {
+	if s.file == nil {
+		return span{}, fmt.Errorf("history file closed")
+	}
+	data = append(data, '\n')
+	line := span{offset: s.size, length: len(data)}
+	n, err := s.file.Write(data)
+	s.size += int64(n)
+	if err != nil {
+		return span{}, err
+	}
+	s.lines++
+	return line, nil
+}
+
+// compact rewrites the file with only the latest version of each entry,
+// frames included. The caller must hold s.mu.
+func (s *store) compact() error {
+	tmpPath := s.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+
+	// The records only change once the new file is in place
+	lines := make(map[string]span, len(s.order))
+	var size int64
+	writer := bufio.NewWriter(tmp)
+	for _, id := range s.order {
+		entry, err := s.read(s.entries[id])
+		if err == nil {
+			var data []byte
+			data, err = json.Marshal(entry)
+			data = append(data, '\n')
+			if err == nil {
+				_, err = writer.Write(data)
+			}
+			lines[id] = span{offset: size, length: len(data)}
+			size += int64(len(data))
+		}
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmpPath)
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	s.file.Close()
+	s.file = nil
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		os.Remove(tmpPath)
+		s.file, _ = os.OpenFile(s.path, os.O_RDWR|os.O_APPEND, 0o600)
+		return err
+	}
+	file, err := os.OpenFile(s.path, os.O_RDWR|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	s.file = file
+	s.size = size
+	s.lines = len(s.order)
+	for id, line := range lines {
+		r := s.entries[id]
+		if len(r.entry.Frames) > 0 || len(r.frames) > 0 {
+			r.frames = []span{line}
+		}
+		r.entry = metadata(r.entry)
+		r.line = line
+	}
+	return nil
+}
+
+// Save records an entry, replacing any previous version with the same ID
+func Save(entry *Entry) {
+	if entry == nil || entry.ID == "" {
+		return
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Error marshaling history entry: %v", err)
+		return
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if r, exists := db.entries[entry.ID]; exists && r.line.length == 0 && entry.Frames == nil && r.entry.Frames != nil {
+		// Write the frames kept in memory along with the entry
+		stored := *entry
+		stored.Frames = r.entry.Frames
+		if data, err = json.Marshal(stored); err != nil {
+			log.Printf("Error marshaling history entry: %v", err)
+			return
+		}
+		entry = &stored
+	}
+
+	line, err := db.append(data)
+	if err != nil {
+		if db.file != nil {
+			log.Printf("Erreur écriture historique: %v", err)
+		}
+		db.keep(entry)
+		return
+	}
+	db.index(entry, line)
+}
+
+// keep stores a whole entry in memory when it cannot be written to the file.
+// The caller must hold s.mu.
+func (s *store) keep(entry *Entry) {
+	stored := *entry
+	r, exists := s.entries[entry.ID]
+	if !exists {
+		r = &record{}
+		s.entries[entry.ID] = r
+		s.order = append(s.order, entry.ID)
+	} else if stored.Frames == nil {
+		// Frames are saved separately with AddFrame
+		stored.Frames = s.readEntry(r).Frames
+	}
+	*r = record{entry: stored}
+}
+
+// AddFrame records a WebSocket frame relayed after the upgrade of an entry
+func AddFrame(entryID string, frame Frame) {
+	data, err := json.Marshal(frameLine{EntryID: entryID, Frame: frame})
+	if err != nil {
+		log.Printf("Error marshaling history frame: %v", err)
+		return
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	r, exists := db.entries[entryID]
+	if !exists {
+		return
+	}
+	if r.line.length == 0 {
+		// The entry is only in memory
+		r.entry.Frames = append(r.entry.Frames, frame)
+		return
+	}
+	line, err := db.append(data)
+	if err != nil {
+		log.Printf("Erreur écriture historique: %v", err)
+		return
+	}
+	r.frames = append(r.frames, line)
+}
+
+// Get returns a copy of the entry with the given ID
+func Get(id string) (Entry, bool) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	r, exists := db.entries[id]
+	if !exists {
+		return Entry{}, false
+	}
+	return db.readEntry(r), true
+}
+
+// Query returns the entries matching the filter, newest first
+func Query(filter Filter) Page {
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = defaultLimit
+	}
+	if limit > maxLimit {
+		limit = maxLimit
+	}
+	offset := filter.Offset
+	if offset < 0 {
+		offset = 0
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	page := Page{Offset: offset, Entries: []Entry{}}
+	for i := len(db.order) - 1; i >= 0; i-- {
+		r := db.entries[db.order[i]]
+		if !filter.matches(&r.entry) {
+			continue
+		}
+		if page.Total >= offset && len(page.Entries) < limit {
+			page.Entries = append(page.Entries, db.readEntry(r))
+		}
+		page.Total++
+	}
+	return page
+}
+
+// Entries returns every entry matching the filter, oldest first.
+// Offset and Limit are ignored.
+func Entries(filter Filter) []Entry {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	entries := []Entry{}
+	for _, id := range db.order {
+		if r := db.entries[id]; filter.matches(&r.entry) {
+			entries = append(entries, db.readEntry(r))
+		}
+	}
+	return entries
+}
+
+// Clear removes every entry from memory and from disk
+func Clear() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// Streamed bodies are only referenced by their entries
+	for _, r := range db.entries {
+		for _, path := range []string{r.entry.RequestBodyInfo.File, r.entry.ResponseBodyInfo.File} {
+			if path != "" {
+				os.Remove(path)
+			}
+		}
+	}
+
+	db.entries = make(map[string]*record)
+	db.order = nil
+	db.lines = 0
+	db.size = 0
+
+	if db.file == nil {
+		return nil
+	}
+	if err := db.file.Truncate(0); err != nil {
+		return fmt.Errorf("truncate history: %v", err)
+	}
+	return nil
+}
+
+func (f Filter) matches(entry *Entry) bool {
+	if f.Host != "" && !strings.Contains(strings.ToLower(entry.Host), strings.ToLower(f.Host)) {
+		return false
+	}
+	if f.Method != "" && !strings.EqualFold(entry.Method, f.Method) {
+		return false
+	}
+	if f.Status != "" && entry.Status != f.Status {
+		return false
+	}
+	if f.StatusCode != 0 && entry.StatusCode != f.StatusCode {
+		return false
+	}
+	if f.ContentType != "" && !strings.Contains(strings.ToLower(entry.ContentType), strings.ToLower(f.ContentType)) {
+		return false
+	}
+	if !f.Since.IsZero() && entry.StartedAt.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && entry.StartedAt.After(f.Until) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,120 @@
+package history
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	if err := Open(path); err != nil {
+		t.Fatal(err)
+	}
+
+	started := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	first := &Entry{ID: "1", StartedAt: started, Method: "POST", Host: "api.test", Status: "pending"}
+	first.SetRequestBody([]byte("request"))
+	Save(first)
+	first.Status = "sent"
+	first.StatusCode = 200
+	first.SetResponseBody([]byte{0xff, 0x00})
+	first.ResponseBodyInfo.SetRaw([]byte("gzipped"), "gzip")
+	Save(first)
+	AddFrame("1", Frame{ID: "f1", Opcode: 1, Payload: "hello"})
+	AddFrame("1", Frame{ID: "f2", Opcode: 1, Payload: "world"})
+	AddFrame("missing", Frame{ID: "f3"})
+	Save(&Entry{ID: "2", StartedAt: started.Add(time.Second), Method: "GET", Host: "www.test", Status: "sent",
+		Frames: []Frame{{ID: "imported", Opcode: 2, Payload: "AA==", Encoding: "base64"}}})
+
+	check := func(step string) {
+		t.Helper()
+		// Bodies and frames stay on disk
+		for id, r := range db.entries {
+			if r.entry.RequestBody != "" || r.entry.ResponseBody != "" || r.entry.ResponseBodyInfo.Raw != "" || r.entry.Frames != nil {
+				t.Errorf("%s: entry %s kept in memory: %+v", step, id, r.entry)
+			}
+		}
+
+		entry, exists := Get("1")
+		if !exists {
+			t.Fatalf("%s: entry 1 not found", step)
+		}
+		request, _ := entry.RequestBodyBytes()
+		response, _ := entry.ResponseBodyBytes()
+		raw, _ := entry.RawRequestBodyBytes()
+		if entry.Status != "sent" || string(request) != "request" || string(response) != "\xff\x00" || string(raw) != "request" {
+			t.Errorf("%s: entry 1 = %+v", step, entry)
+		}
+		if entry.ResponseBodyInfo.Raw == "" {
+			t.Errorf("%s: raw response body lost", step)
+		}
+		if len(entry.Frames) != 2 || entry.Frames[0].Payload != "hello" || entry.Frames[1].Payload != "world" {
+			t.Errorf("%s: frames of entry 1 = %+v", step, entry.Frames)
+		}
+
+		page := Query(Filter{Host: "TEST"})
+		if page.Total != 2 || len(page.Entries) != 2 || page.Entries[0].ID != "2" || len(page.Entries[0].Frames) != 1 {
+			t.Errorf("%s: Query = %+v", step, page)
+		}
+		if page.Entries[1].RequestBody != "request" {
+			t.Errorf("%s: Query without bodies: %+v", step, page.Entries[1])
+		}
+		if entries := Entries(Filter{Method: "post"}); len(entries) != 1 || entries[0].ID != "1" {
+			t.Errorf("%s: Entries = %+v", step, entries)
+		}
+	}
+	check("saved")
+
+	// Most lines are superseded or frames: reloading compacts the file
+	if err := Open(path); err != nil {
+		t.Fatal(err)
+	}
+	check("compacted")
+	data, _ := os.ReadFile(path)
+	if lines := strings.Count(string(data), "\n"); lines != 2 || db.lines != 2 {
+		t.Errorf("compacted file has %d lines, %d counted", lines, db.lines)
+	}
+
+	// Frames added after the compaction follow the entry line holding the earlier ones
+	AddFrame("1", Frame{ID: "f4", Opcode: 1, Payload: "again"})
+	Save(&Entry{ID: "2", StartedAt: started.Add(time.Second), Method: "GET", Host: "www.test", Status: "sent"})
+	if err := Open(path); err != nil {
+		t.Fatal(err)
+	}
+	if db.lines != 4 {
+		t.Errorf("reloaded %d lines, want 4 without compaction", db.lines)
+	}
+	if entry, _ := Get("1"); len(entry.Frames) != 3 || entry.Frames[2].Payload != "again" {
+		t.Errorf("frames after compaction = %+v", entry.Frames)
+	}
+	if entry, _ := Get("2"); len(entry.Frames) != 1 {
+		t.Errorf("frames of entry 2 after an update = %+v", entry.Frames)
+	}
+
+	if err := Clear(); err != nil {
+		t.Fatal(err)
+	}
+	Save(&Entry{ID: "3", Method: "GET"})
+	if entry, exists := Get("3"); !exists || entry.Method != "GET" || Query(Filter{}).Total != 1 {
+		t.Errorf("after Clear: %+v, %v", entry, exists)
+	}
+}
+
+func TestStoreWithoutFile(t *testing.T) {
+	db = &store{entries: make(map[string]*record)}
+
+	entry := &Entry{ID: "1", Method: "GET", Status: "pending"}
+	entry.SetRequestBody([]byte("kept"))
+	Save(entry)
+	AddFrame("1", Frame{ID: "f1", Payload: "frame"})
+	entry.Status = "sent"
+	Save(entry)
+
+	got, exists := Get("1")
+	if !exists || got.Status != "sent" || got.RequestBody != "kept" || len(got.Frames) != 1 {
+		t.Errorf("Get = %+v, %v", got, exists)
+	}
+}
@@ -0,0 +1,451 @@
+package intruder
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"proxy-interceptor/proxy"
+	"proxy-interceptor/websocket"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Marker delimits payload positions in a template, e.g. "user=§admin§"
+const Marker = "§"
+
+// maxRequests bounds the number of requests of a single attack
+const maxRequests = 1000000
+
+// requestTimeout bounds each request of an attack, its response body included
+const requestTimeout = 30 * time.Second
+
+// Template is the request to fuzz. Positions are marked in the URL, the
+// header values and the body; the text between markers is the default value.
+type Template struct {
+	Method  string              `json:"method"`
+	URL     string              `json:"url"`
+	Headers map[string][]string `json:"headers"`
+	Body    string              `json:"body"`
+}
+
+// Attack is a fuzzing run definition
+type Attack struct {
+	Template        Template     `json:"template"`
+	Mode            string       `json:"mode"` // "sniper", "battering_ram", "pitchfork", "cluster_bomb"
+	Payloads        []PayloadSet `json:"payloads"`
+	Concurrency     int          `json:"concurrency"`
+	RateLimit       float64      `json:"rate_limit"` // Requests per second, 0 for unlimited
+	Grep            []string     `json:"grep"`       // Regular expressions searched in responses
+	FollowRedirects bool         `json:"follow_redirects"`
+}
+
+// Result is streamed to the UI for every request of an attack
+type Result struct {
+	Index      int      `json:"index"`
+	Position   int      `json:"position,omitempty"` // Fuzzed position in sniper mode, 1-based
+	Payloads   []string `json:"payloads"`
+	StatusCode int      `json:"status_code,omitempty"`
+	Length     int      `json:"length"`
+	Duration   float64  `json:"duration"` // Milliseconds
+	Matches    []string `json:"matches,omitempty"`
+	Error      string   `json:"error,omitempty"`
+}
+
+// Summary is sent when an attack finishes
+type Summary struct {
+	Total     int  `json:"total"`
+	Sent      int  `json:"sent"`
+	Errors    int  `json:"errors"`
+	Cancelled bool `json:"cancelled"`
+}
+
+// segment is a piece of a templated field, either literal text or a position
+type segment struct {
+	text     string
+	position int // -1 for literal text
+}
+
+type field []segment
+
+// compiledAttack is an attack ready to be run
+type compiledAttack struct {
+	Attack
+	method   field
+	url      field
+	headers  map[string][]field
+	body     field
+	defaults []string
+	sets     [][]string
+	grep     []*regexp.Regexp
+	total    int
+}
+
+var (
+	running   = make(map[string]context.CancelFunc)
+	runningMu sync.Mutex
+)
+
+// Start handles intruder commands coming from the WebSocket
+func Start() {
+	go func() {
+		for request := range websocket.IntruderChannel {
+			switch request.Action {
+			case "start":
+				var attack Attack
+				if err := json.Unmarshal(request.Attack, &attack); err != nil {
+					broadcast("error", request.ID, fmt.Sprintf("invalid attack: %v", err))
+					continue
+				}
+				if err := Run(request.ID, attack); err != nil {
+					broadcast("error", request.ID, err.Error())
+				}
+			case "stop":
+				Stop(request.ID)
+			default:
+				log.Printf("Unknown intruder action: %s", request.Action)
+			}
+		}
+	}()
+}
+
+// Run validates the attack and starts it in the background
+func Run(id string, attack Attack) error {
+	compiled, err := compile(attack)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	runningMu.Lock()
+	if _, exists := running[id]; exists {
+		runningMu.Unlock()
+		cancel()
+		return fmt.Errorf("attack %s is already running", id)
+	}
+	running[id] = cancel
+	runningMu.Unlock()
+
+	log.Printf("Intruder: attack %s started (%s, %d requests)", id, compiled.Mode, compiled.total)
+	broadcast("intruder_started", id, map[string]int{"total": compiled.total})
+
+	go func() {
+		summary := compiled.run(ctx, id)
+
+		runningMu.Lock()
+		delete(running, id)
+		runningMu.Unlock()
+		cancel()
+
+		log.Printf("Intruder: attack %s finished (%d/%d sent, %d errors)", id, summary.Sent, summary.Total, summary.Errors)
+		broadcast("intruder_done", id, summary)
+	}()
+	return nil
+}
+
+// Stop cancels a running attack
+func Stop(id string) {
+	runningMu.Lock()
+	defer runningMu.Unlock()
+
+	if cancel, exists := running[id]; exists {
+		cancel()
+	}
+}
+
+func compile(attack Attack) (*compiledAttack, error) {
+	c := &compiledAttack{Attack: attack, headers: make(map[string][]field)}
+	if c.Template.Method == "" {
+		c.Template.Method = http.MethodGet
+	}
+	if c.Concurrency <= 0 {
+		c.Concurrency = 5
+	}
+
+	// Number positions in a stable order: method, URL, headers by name, body
+	var err error
+	if c.method, err = c.parse(c.Template.Method); err != nil {
+		return nil, fmt.Errorf("method: %v", err)
+	}
+	if c.url, err = c.parse(c.Template.URL); err != nil {
+		return nil, fmt.Errorf("url: %v", err)
+	}
+	names := make([]string, 0, len(c.Template.Headers))
+	for name := range c.Template.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range c.Template.Headers[name] {
+			f, err := c.parse(value)
+			if err != nil {
+				return nil, fmt.Errorf("header %s: %v", name, err)
+			}
+			c.headers[name] = append(c.headers[name], f)
+		}
+	}
+	if c.body, err = c.parse(c.Template.Body); err != nil {
+		return nil, fmt.Errorf("body: %v", err)
+	}
+
+	positions := len(c.defaults)
+	if positions == 0 {
+		return nil, fmt.Errorf("no payload position marked with %s", Marker)
+	}
+
+	for i, set := range c.Payloads {
+		payloads, err := set.Generate()
+		if err != nil {
+			return nil, fmt.Errorf("payload set %d: %v", i+1, err)
+		}
+		c.sets = append(c.sets, payloads)
+	}
+	if len(c.sets) == 0 {
+		return nil, fmt.Errorf("no payload set")
+	}
+
+	switch c.Mode {
+	case "sniper", "":
+		c.Mode = "sniper"
+		c.total = positions * len(c.sets[0])
+	case "battering_ram":
+		c.total = len(c.sets[0])
+	case "pitchfork":
+		if len(c.sets) < positions {
+			return nil, fmt.Errorf("pitchfork needs %d payload sets, got %d", positions, len(c.sets))
+		}
+		c.total = len(c.sets[0])
+		for _, set := range c.sets[:positions] {
+			if len(set) < c.total {
+				c.total = len(set)
+			}
+		}
+	case "cluster_bomb":
+		if len(c.sets) < positions {
+			return nil, fmt.Errorf("cluster bomb needs %d payload sets, got %d", positions, len(c.sets))
+		}
+		c.total = 1
+		for _, set := range c.sets[:positions] {
+			c.total *= len(set)
+			if c.total > maxRequests {
+				break
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown attack mode %q", c.Mode)
+	}
+	if c.total > maxRequests {
+		return nil, fmt.Errorf("attack too large (more than %d requests)", maxRequests)
+	}
+
+	for _, pattern := range c.Grep {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("grep %q: %v", pattern, err)
+		}
+		c.grep = append(c.grep, re)
+	}
+
+	return c, nil
+}
+
+// parse splits a templated value into literal text and positions
+func (c *compiledAttack) parse(value string) (field, error) {
+	var f field
+	for {
+		start := strings.Index(value, Marker)
+		if start < 0 {
+			if value != "" {
+				f = append(f, segment{text: value, position: -1})
+			}
+			return f, nil
+		}
+		end := strings.Index(value[start+len(Marker):], Marker)
+		if end < 0 {
+			return nil, fmt.Errorf("unbalanced %s marker", Marker)
+		}
+		end += start + len(Marker)
+
+		if start > 0 {
+			f = append(f, segment{text: value[:start], position: -1})
+		}
+		f = append(f, segment{position: len(c.defaults)})
+		c.defaults = append(c.defaults, value[start+len(Marker):end])
+		value = value[end+len(Marker):]
+	}
+}
+
+func (f field) render(values []string) string {
+	var b strings.Builder
+	for _, s := range f {
+		if s.position < 0 {
+			b.WriteString(s.text)
+		} else {
+			b.WriteString(values[s.position])
+		}
+	}
+	return b.String()
+}
+
+// assign returns the value of every position for the i-th request, and the
+// fuzzed position in sniper mode
+func (c *compiledAttack) assign(i int) ([]string, int) {
+	values := make([]string, len(c.defaults))
+	switch c.Mode {
+	case "sniper":
+		set := c.sets[0]
+		copy(values, c.defaults)
+		position := i / len(set)
+		values[position] = set[i%len(set)]
+		return values, position + 1
+	case "battering_ram":
+		for p := range values {
+			values[p] = c.sets[0][i]
+		}
+	case "pitchfork":
+		for p := range values {
+			values[p] = c.sets[p][i]
+		}
+	case "cluster_bomb":
+		// Mixed radix decomposition, last position fastest
+		for p := len(values) - 1; p >= 0; p-- {
+			set := c.sets[p]
+			values[p] = set[i%len(set)]
+			i /= len(set)
+		}
+	}
+	return values, 0
+}
+
+func (c *compiledAttack) run(ctx context.Context, id string) Summary {
+	client := proxy.DirectClient()
+	if c.FollowRedirects {
+		followClient := *client
+		followClient.CheckRedirect = nil
+		client = &followClient
+	}
+
+	var throttle <-chan time.Time
+	if c.RateLimit > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / c.RateLimit))
+		defer ticker.Stop()
+		throttle = ticker.C
+	}
+
+	jobs := make(chan int)
+	results := make(chan Result)
+	var wg sync.WaitGroup
+	for w := 0; w < c.Concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results <- c.send(ctx, client, i)
+			}
+		}()
+	}
+
+	go func() {
+		defer close(jobs)
+		for i := 0; i < c.total; i++ {
+			if throttle != nil {
+				select {
+				case <-throttle:
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case jobs <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	summary := Summary{Total: c.total}
+	for result := range results {
+		summary.Sent++
+		if result.Error != "" {
+			summary.Errors++
+		}
+		broadcast("intruder_result", id, result)
+	}
+	summary.Cancelled = ctx.Err() != nil && summary.Sent < summary.Total
+	return summary
+}
+
+func (c *compiledAttack) send(ctx context.Context, client *http.Client, i int) Result {
+	values, position := c.assign(i)
+	result := Result{Index: i, Position: position, Payloads: values}
+
+	// The proxy's client does not bound reading the body
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, c.method.render(values), c.url.render(values), strings.NewReader(c.body.render(values)))
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	for name, fields := range c.headers {
+		for _, f := range fields {
+			req.Header.Add(name, f.render(values))
+		}
+	}
+	if host := req.Header.Get("Host"); host != "" {
+		req.Host = host
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		result.Duration = milliseconds(time.Since(start))
+		result.Error = err.Error()
+		return result
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	result.Duration = milliseconds(time.Since(start))
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	result.StatusCode = resp.StatusCode
+	result.Length = len(body)
+
+	// Headers are searched as well, e.g. to spot a Set-Cookie on success
+	var raw bytes.Buffer
+	resp.Header.Write(&raw)
+	raw.Write(body)
+	for _, re := range c.grep {
+		if re.Match(raw.Bytes()) {
+			result.Matches = append(result.Matches, re.String())
+		}
+	}
+	return result
+}
+
+func broadcast(messageType string, id string, data any) {
+	jsonData, err := json.Marshal(websocket.Message{Type: messageType, ID: id, Data: data})
+	if err != nil {
+		log.Printf("Error marshaling JSON: %v", err)
+		return
+	}
+	websocket.BroadcastChannel <- jsonData
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
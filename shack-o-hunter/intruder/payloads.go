@@ -0,0 +1,237 @@
+package intruder
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxPayloads bounds the size of a single payload set
+const maxPayloads = 1000000
+
+// PayloadSet describes where the payloads of one set come from
+type PayloadSet struct {
+	Type string `json:"type"` // "list", "file", "numbers", "charset", "case"
+
+	// "list" and "case"
+	Values []string `json:"values,omitempty"`
+
+	// "file": one payload per line
+	Path string `json:"path,omitempty"`
+
+	// "numbers": From to To inclusive, zero padded to Width digits
+	From  int `json:"from,omitempty"`
+	To    int `json:"to,omitempty"`
+	Step  int `json:"step,omitempty"`
+	Width int `json:"width,omitempty"`
+
+	// "charset": every string of MinLength to MaxLength characters
+	Charset   string `json:"charset,omitempty"`
+	MinLength int    `json:"min_length,omitempty"`
+	MaxLength int    `json:"max_length,omitempty"`
+
+	// Applied in order to every payload: "url", "url_all", "base64", "hex", "html", "lower", "upper"
+	Encoders []string `json:"encoders,omitempty"`
+}
+
+// Generate returns the encoded payloads of the set
+func (p PayloadSet) Generate() ([]string, error) {
+	var payloads []string
+	var err error
+
+	switch p.Type {
+	case "list", "":
+		payloads = p.Values
+	case "file":
+		payloads, err = readWordList(p.Path)
+	case "numbers":
+		payloads, err = numberRange(p.From, p.To, p.Step, p.Width)
+	case "charset":
+		payloads, err = bruteForce(p.Charset, p.MinLength, p.MaxLength)
+	case "case":
+		payloads = caseVariants(p.Values)
+	default:
+		return nil, fmt.Errorf("unknown payload type %q", p.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(payloads) > maxPayloads {
+		return nil, fmt.Errorf("payload set too large (%d > %d)", len(payloads), maxPayloads)
+	}
+
+	if len(p.Encoders) == 0 {
+		return payloads, nil
+	}
+
+	encoded := make([]string, len(payloads))
+	for i, payload := range payloads {
+		for _, encoder := range p.Encoders {
+			payload, err = encode(encoder, payload)
+			if err != nil {
+				return nil, err
+			}
+		}
+		encoded[i] = payload
+	}
+	return encoded, nil
+}
+
+func readWordList(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var words []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if len(words) >= maxPayloads {
+			return nil, fmt.Errorf("word list %s has more than %d lines", path, maxPayloads)
+		}
+		words = append(words, strings.TrimRight(scanner.Text(), "\r"))
+	}
+	return words, scanner.Err()
+}
+
+func numberRange(from, to, step, width int) ([]string, error) {
+	if step == 0 {
+		step = 1
+	}
+	if step < 0 {
+		step = -step
+	}
+	if from > to {
+		step = -step
+	}
+
+	// The distance between two ints always fits in a uint64
+	span := uint64(to) - uint64(from)
+	stride := uint64(step)
+	if from > to {
+		span, stride = -span, -stride
+	}
+	if span/stride >= maxPayloads {
+		return nil, fmt.Errorf("number range too large (> %d payloads)", maxPayloads)
+	}
+	count := int(span/stride) + 1
+
+	numbers := make([]string, 0, count)
+	for i, n := 0, from; i < count; i, n = i+1, n+step {
+		if width > 0 {
+			numbers = append(numbers, fmt.Sprintf("%0*d", width, n))
+		} else {
+			numbers = append(numbers, strconv.Itoa(n))
+		}
+	}
+	return numbers, nil
+}
+
+func bruteForce(charset string, minLength, maxLength int) ([]string, error) {
+	chars := []rune(charset)
+	if len(chars) == 0 {
+		return nil, fmt.Errorf("empty charset")
+	}
+	if minLength < 1 {
+		minLength = 1
+	}
+	if maxLength < minLength {
+		maxLength = minLength
+	}
+
+	// Check the total size before generating anything
+	total, size := 0, 1
+	for length := 1; length <= maxLength; length++ {
+		size *= len(chars)
+		if size > maxPayloads {
+			return nil, fmt.Errorf("charset brute force too large (> %d payloads)", maxPayloads)
+		}
+		if length >= minLength {
+			total += size
+		}
+	}
+	if total > maxPayloads {
+		return nil, fmt.Errorf("charset brute force too large (%d > %d)", total, maxPayloads)
+	}
+
+	payloads := make([]string, 0, total)
+	for length := minLength; length <= maxLength; length++ {
+		indexes := make([]int, length)
+		for {
+			word := make([]rune, length)
+			for i, idx := range indexes {
+				word[i] = chars[idx]
+			}
+			payloads = append(payloads, string(word))
+
+			// Increment the mixed radix counter, last character fastest
+			pos := length - 1
+			for pos >= 0 {
+				indexes[pos]++
+				if indexes[pos] < len(chars) {
+					break
+				}
+				indexes[pos] = 0
+				pos--
+			}
+			if pos < 0 {
+				break
+			}
+		}
+	}
+	return payloads, nil
+}
+
+// caseVariants returns each word as is, lower case, upper case and capitalized
+func caseVariants(words []string) []string {
+	var variants []string
+	for _, word := range words {
+		seen := make(map[string]bool)
+		capitalized := word
+		if word != "" {
+			first, size := utf8.DecodeRuneInString(word)
+			capitalized = string(unicode.ToUpper(first)) + strings.ToLower(word[size:])
+		}
+		for _, v := range []string{word, strings.ToLower(word), strings.ToUpper(word), capitalized} {
+			if !seen[v] {
+				seen[v] = true
+				variants = append(variants, v)
+			}
+		}
+	}
+	return variants
+}
+
+func encode(encoder string, payload string) (string, error) {
+	switch encoder {
+	case "url":
+		return url.QueryEscape(payload), nil
+	case "url_all":
+		var b strings.Builder
+		for i := 0; i < len(payload); i++ {
+			fmt.Fprintf(&b, "%%%02X", payload[i])
+		}
+		return b.String(), nil
+	case "base64":
+		return base64.StdEncoding.EncodeToString([]byte(payload)), nil
+	case "hex":
+		return hex.EncodeToString([]byte(payload)), nil
+	case "html":
+		return html.EscapeString(payload), nil
+	case "lower":
+		return strings.ToLower(payload), nil
+	case "upper":
+		return strings.ToUpper(payload), nil
+	default:
+		return "", fmt.Errorf("unknown encoder %q", encoder)
+	}
+}
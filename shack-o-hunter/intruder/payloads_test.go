@@ -0,0 +1,82 @@
+package intruder
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGenerate(t *testing.T) {
+	wordList := filepath.Join(t.TempDir(), "words.txt")
+	if err := os.WriteFile(wordList, []byte("admin\r\nroot\n\nguest"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		set  PayloadSet
+		want []string
+	}{
+		{"list", PayloadSet{Type: "list", Values: []string{"a", "b"}}, []string{"a", "b"}},
+		{"default type", PayloadSet{Values: []string{"x"}}, []string{"x"}},
+		{"file", PayloadSet{Type: "file", Path: wordList}, []string{"admin", "root", "", "guest"}},
+		{"numbers", PayloadSet{Type: "numbers", From: 1, To: 3}, []string{"1", "2", "3"}},
+		{"numbers padded", PayloadSet{Type: "numbers", From: 8, To: 12, Step: 2, Width: 3}, []string{"008", "010", "012"}},
+		{"numbers descending", PayloadSet{Type: "numbers", From: 3, To: -3, Step: 3}, []string{"3", "0", "-3"}},
+		{"numbers single", PayloadSet{Type: "numbers", From: 5, To: 5}, []string{"5"}},
+		{"numbers extreme step", PayloadSet{Type: "numbers", From: math.MinInt64, To: math.MaxInt64, Step: math.MaxInt64},
+			[]string{"-9223372036854775808", "-1", "9223372036854775806"}},
+		{"numbers extreme descending", PayloadSet{Type: "numbers", From: math.MaxInt64, To: math.MinInt64, Step: math.MinInt64},
+			[]string{"9223372036854775807", "-1"}},
+		{"charset", PayloadSet{Type: "charset", Charset: "ab", MinLength: 1, MaxLength: 2},
+			[]string{"a", "b", "aa", "ab", "ba", "bb"}},
+		{"charset fixed length", PayloadSet{Type: "charset", Charset: "01", MinLength: 3},
+			[]string{"000", "001", "010", "011", "100", "101", "110", "111"}},
+		{"charset multi-byte", PayloadSet{Type: "charset", Charset: "éß"}, []string{"é", "ß"}},
+		{"case", PayloadSet{Type: "case", Values: []string{"aDmin"}}, []string{"aDmin", "admin", "ADMIN", "Admin"}},
+		{"case duplicates", PayloadSet{Type: "case", Values: []string{"Admin", "42"}}, []string{"Admin", "admin", "ADMIN", "42"}},
+		{"case multi-byte", PayloadSet{Type: "case", Values: []string{"élan"}}, []string{"élan", "ÉLAN", "Élan"}},
+		{"case empty", PayloadSet{Type: "case", Values: []string{""}}, []string{""}},
+		{"encoders in order", PayloadSet{Values: []string{"a b"}, Encoders: []string{"upper", "base64"}}, []string{"QSBC"}},
+		{"url", PayloadSet{Values: []string{"a&b=c d"}, Encoders: []string{"url"}}, []string{"a%26b%3Dc+d"}},
+		{"url_all", PayloadSet{Values: []string{"a/é"}, Encoders: []string{"url_all"}}, []string{"%61%2F%C3%A9"}},
+		{"hex", PayloadSet{Values: []string{"AZ"}, Encoders: []string{"hex"}}, []string{"415a"}},
+		{"html", PayloadSet{Values: []string{`<a href="x">`}, Encoders: []string{"html"}}, []string{"&lt;a href=&#34;x&#34;&gt;"}},
+		{"lower", PayloadSet{Values: []string{"ÉLAN"}, Encoders: []string{"lower"}}, []string{"élan"}},
+	}
+	for _, tt := range tests {
+		got, err := tt.set.Generate()
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if strings.Join(got, "\x00") != strings.Join(tt.want, "\x00") || len(got) != len(tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestGenerateErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		set  PayloadSet
+	}{
+		{"unknown type", PayloadSet{Type: "dictionary"}},
+		{"unknown encoder", PayloadSet{Values: []string{"a"}, Encoders: []string{"rot13"}}},
+		{"missing file", PayloadSet{Type: "file", Path: filepath.Join(t.TempDir(), "missing.txt")}},
+		{"number range too large", PayloadSet{Type: "numbers", From: 0, To: maxPayloads}},
+		{"number range overflow", PayloadSet{Type: "numbers", From: -9e18, To: 9e18}},
+		{"number range widest", PayloadSet{Type: "numbers", From: math.MinInt64, To: math.MaxInt64}},
+		{"number range widest descending", PayloadSet{Type: "numbers", From: math.MaxInt64, To: math.MinInt64, Step: -1}},
+		{"empty charset", PayloadSet{Type: "charset", MinLength: 1, MaxLength: 2}},
+		{"charset too large", PayloadSet{Type: "charset", Charset: "abcdefghijklmnopqrstuvwxyz", MaxLength: 5}},
+		{"charset length overflow", PayloadSet{Type: "charset", Charset: "ab", MinLength: 1, MaxLength: 1 << 30}},
+	}
+	for _, tt := range tests {
+		if got, err := tt.set.Generate(); err == nil {
+			t.Errorf("%s: no error, %d payloads", tt.name, len(got))
+		}
+	}
+}
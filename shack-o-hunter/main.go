@@ -1,67 +1,110 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
+	"os"
 	"proxy-interceptor/admin"
 	"proxy-interceptor/browsers"
 	"proxy-interceptor/cert"
+	"proxy-interceptor/clientcert"
 	"proxy-interceptor/config"
+	"proxy-interceptor/history"
+	"proxy-interceptor/intruder"
 	"proxy-interceptor/proxy"
+	"proxy-interceptor/repeater"
+	"proxy-interceptor/rules"
 	"proxy-interceptor/server"
 	"proxy-interceptor/websocket"
 	"time"
 )
 
 func main() {
+	// Charger la configuration (fichier, variables d'environnement, options)
+	if err := config.Load(os.Args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			return
+		}
+		log.Fatalf("Configuration invalide: %v", err)
+	}
+
+	cfg := config.GetInstance()
+
+	// Commandes de gestion du CA (ca export|import|rotate) au lieu du proxy
+	if args := config.Args(); len(args) > 0 {
+		if err := runCommand(args); err != nil {
+			log.Fatalf("%v", err)
+		}
+		return
+	}
+
 	// Vérifier si on est admin, sinon demander l'élévation
-	if !admin.IsAdmin() {
+	if cfg.NoPrivilege {
+		log.Println("Mode sans privilèges: le certificat CA ne sera pas installé dans le magasin système")
+	} else if !admin.IsAdmin() {
 		log.Println("Le programme nécessite des privilèges administrateur pour installer le certificat CA.")
-		log.Println("Demande d'élévation...")
+		log.Println("Demande d'élévation (ou relancez avec -no-privilege)...")
 		if err := admin.RequestElevation(); err != nil {
 			log.Fatalf("Impossible d'obtenir les privilèges administrateur: %v", err)
 		}
 		return
+	} else {
+		log.Println("Démarrage avec privilèges administrateur")
 	}
 
-	log.Println("Démarrage avec privilèges administrateur")
-
 	// Initialiser le certificat CA AVANT de démarrer le proxy
 	if err := cert.InitCA(); err != nil {
 		log.Fatalf("Erreur initialisation CA: %v", err)
 	}
 	log.Println("Certificat CA généré/chargé avec succès")
 
-	// Installer le certificat CA dans le magasin système Windows AVANT tout
-	if cert.CACertPath != "" {
-		if !admin.IsCertInstalledInSystemStore("ShackoDodo Proxy CA") {
-			log.Println("Installation du certificat CA dans le magasin système Windows...")
+	// Charger l'historique du trafic
+	if err := history.Init(); err != nil {
+		log.Printf("Avertissement: historique indisponible: %v", err)
+	}
+
+	// Charger les règles de remplacement
+	if err := rules.Init(); err != nil {
+		log.Printf("Avertissement: règles non chargées: %v", err)
+	}
+
+	// Charger les certificats clients (TLS mutuel)
+	if err := clientcert.Init(); err != nil {
+		log.Printf("Avertissement: certificats clients non chargés: %v", err)
+	}
+
+	// Installer le certificat CA dans le magasin système AVANT tout
+	if cert.CACertPath != "" && !cfg.NoPrivilege {
+		if !admin.IsCertInstalledInSystemStore(cert.CAName()) {
+			log.Println("Installation du certificat CA dans le magasin système...")
 			if err := admin.InstallCertToSystemStore(cert.CACertPath); err != nil {
 				log.Printf("Avertissement: impossible d'installer le certificat dans le magasin système: %v", err)
 			} else {
-				log.Println("Certificat CA installé dans le magasin système Windows (Trusted Root)")
+				log.Println("Certificat CA installé dans le magasin système")
 			}
 		} else {
 			log.Println("Certificat CA déjà présent dans le magasin système")
 		}
-	}
 
-	// Petit délai pour s'assurer que Windows a bien traité le certificat
-	time.Sleep(1 * time.Second)
-
-	// Get config instance
-	cfg := config.GetInstance()
+		// Petit délai pour s'assurer que le système a bien pris en compte le certificat
+		time.Sleep(1 * time.Second)
+	}
 
 	// Maintenant démarrer le proxy
 	proxy.Start()
-	log.Printf("Proxy démarré sur 127.0.0.1:%d", cfg.ProxyPort)
+	log.Printf("Proxy démarré sur %s:%d", cfg.ProxyAddress, cfg.ProxyPort)
 
 	// Démarrer le WebSocket
 	websocket.Start()
 	log.Println("WebSocket démarré")
 
+	// Démarrer le repeater et l'intruder
+	repeater.Start()
+	intruder.Start()
+
 	// Démarrer le serveur frontend React
-	server.Start("3000")
+	server.Start()
 
 	// Délai pour s'assurer que tout est prêt
 	time.Sleep(1 * time.Second)
@@ -78,8 +121,10 @@ func main() {
 	}
 
 	fmt.Println("\nProxy ShackoDodo démarré!")
-	fmt.Println("- Interface web: http://localhost:3000")
-	fmt.Println("- Le navigateur va s'ouvrir automatiquement")
+	fmt.Printf("- Interface web: http://localhost:%d\n", cfg.FrontendPort)
+	if cfg.AutoOpen {
+		fmt.Println("- Le navigateur va s'ouvrir automatiquement")
+	}
 	fmt.Println("- Navigateurs supportés: Firefox, Chrome, Edge")
 	fmt.Println("- Appuyez sur Ctrl+C pour arrêter")
 
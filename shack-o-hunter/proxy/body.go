@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"log"
+	"net/http"
+	"proxy-interceptor/config"
+	"proxy-interceptor/content"
+	"proxy-interceptor/history"
+	"proxy-interceptor/websocket"
+	"sync"
+)
+
+// readBody buffers a body up to the memory limit. A larger body is returned
+// as a spool streaming the buffered part then the rest of r, and the
+// buffered part is kept for the preview.
+func readBody(r io.ReadCloser) ([]byte, *spool, error) {
+	limit := config.GetInstance().BodyMemoryLimit
+	data, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return data, nil, err
+	}
+	if len(data) <= limit {
+		return data, nil, nil
+	}
+	return data, newSpool(data, r), nil
+}
+
+// spool streams a body too large to be buffered, copying it to a temporary
+// file on the way when it is recorded in the history
+type spool struct {
+	io.Reader
+	rest     io.Closer
+	recorder *content.Recorder // nil unless kept, or if the temporary file could not be created
+	done     chan struct{}
+	once     sync.Once
+}
+
+func newSpool(head []byte, rest io.ReadCloser) *spool {
+	s := &spool{rest: rest, done: make(chan struct{})}
+	s.Reader = io.MultiReader(bytes.NewReader(head), rest)
+	return s
+}
+
+// keep copies the body to a temporary file as it is read. It is only called
+// once the history entry is sure to be saved, which is what removes the
+// file, and before the body is read.
+func (s *spool) keep() {
+	recorder, err := content.NewRecorder(config.GetInstance().BodyPreviewSize + 4)
+	if err != nil {
+		log.Printf("Corps volumineux non enregistré: %v", err)
+		return
+	}
+	s.recorder = recorder
+	s.Reader = io.TeeReader(s.Reader, recorder)
+}
+
+// Close is called by whoever consumes the body, possibly another goroutine
+// for a request body sent by the transport
+func (s *spool) Close() error {
+	s.once.Do(func() { close(s.done) })
+	return s.rest.Close()
+}
+
+// record waits until the body has been consumed and returns the recorder
+func (s *spool) record() *content.Recorder {
+	<-s.done
+	if s.recorder != nil {
+		if err := s.recorder.Close(); err != nil {
+			log.Printf("Erreur écriture du corps volumineux: %v", err)
+		}
+	}
+	return s.recorder
+}
+
+// uiBody encodes a body for the interface. A streamed body only comes as a
+// preview of its first bytes, and size is -1 when its length is unknown.
+func uiBody(data []byte, streamed bool, size int64) (string, websocket.BodyInfo) {
+	if !streamed {
+		text, encoding := content.Encode(data)
+		return text, websocket.BodyInfo{Encoding: encoding, Size: int64(len(data))}
+	}
+	text, encoding, _ := content.Preview(data, config.GetInstance().BodyPreviewSize)
+	return text, websocket.BodyInfo{Encoding: encoding, Size: size, Truncated: true}
+}
+
+// previewBody records the preview of a streamed body whose copy is missing
+func previewBody(data []byte, size int64) (string, history.BodyInfo) {
+	text, info := uiBody(data, true, size)
+	return text, history.BodyInfo{Encoding: info.Encoding, Size: info.Size}
+}
+
+// codedBody remembers how a buffered body was decoded from its
+// Content-Encoding, to compress it again once it may have been edited
+type codedBody struct {
+	coding string // Content-Encoding the body was decoded from, empty if it was not
+	raw    []byte // Bytes as received
+	plain  []byte // Decoded bytes, to tell whether they changed
+}
+
+// decodeBody returns the plaintext of a body, or the body unchanged if it
+// has no Content-Encoding or one that cannot be decoded
+func decodeBody(header http.Header, raw []byte) ([]byte, codedBody) {
+	coding := header.Get("Content-Encoding")
+	if coding == "" || len(raw) == 0 {
+		return raw, codedBody{}
+	}
+	plain, err := content.Decompress(raw, coding)
+	if err != nil {
+		log.Printf("Corps %s affiché compressé: %v", coding, err)
+		return raw, codedBody{}
+	}
+	return plain, codedBody{coding: coding, raw: raw, plain: plain}
+}
+
+// encode returns the bytes to forward and their Content-Encoding: the bytes
+// as received if the body is unchanged, otherwise the edited body compressed
+// again. When the Content-Encoding header was edited, or compression fails,
+// the plaintext is sent as is.
+func (c codedBody) encode(header http.Header, body []byte) ([]byte, string) {
+	if c.coding == "" || header.Get("Content-Encoding") != c.coding {
+		return body, ""
+	}
+	if bytes.Equal(body, c.plain) {
+		return c.raw, c.coding
+	}
+	encoded, err := content.Compress(body, c.coding)
+	if err != nil {
+		log.Printf("Corps modifié envoyé sans compression: %v", err)
+		header.Del("Content-Encoding")
+		return body, ""
+	}
+	return encoded, c.coding
+}
+
+// describe tells the interface that the body was decoded
+func (c codedBody) describe(info *websocket.BodyInfo) {
+	if c.coding != "" {
+		info.ContentEncoding = c.coding
+		info.Raw = base64.StdEncoding.EncodeToString(c.raw)
+	}
+}
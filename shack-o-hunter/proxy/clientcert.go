@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"proxy-interceptor/clientcert"
+	"sync"
+)
+
+// clientCertKey is the request context key holding the client certificate
+// selected for the request's server
+type clientCertKey struct{}
+
+// withClientCert selects the client certificate registered for req's host,
+// unless one was already selected. It returns nil if there is none.
+func withClientCert(req *http.Request) (*http.Request, *clientcert.Cert) {
+	if c, ok := req.Context().Value(clientCertKey{}).(*clientcert.Cert); ok {
+		return req, c
+	}
+	c := clientcert.For(req.URL.Hostname())
+	if c == nil {
+		return req, nil
+	}
+	return req.WithContext(context.WithValue(req.Context(), clientCertKey{}, c)), c
+}
+
+// transportKey identifies a transport derived from directTransport or
+// invalidTransport
+type transportKey struct {
+	cert    *clientcert.Cert
+	invalid bool
+	ip      string // Verified server address, for servers reached by IP
+}
+
+// maxTransports bounds the derived transports, which are dropped all at once
+// beyond it
+const maxTransports = 256
+
+// transports present a client certificate or verify a server reached by its
+// IP address. Each gets its own transport so that pooled connections never
+// mix identities nor skip the verification.
+var transports = struct {
+	mu         sync.Mutex
+	generation int
+	transports map[transportKey]*http.Transport
+}{transports: make(map[transportKey]*http.Transport)}
+
+// transportFor returns the transport presenting c, or none if c is nil, to
+// host, verifying the server unless invalid
+func transportFor(c *clientcert.Cert, invalid bool, host string) *http.Transport {
+	base := directTransport
+	if invalid {
+		base = invalidTransport
+	}
+	key := transportKey{cert: c, invalid: invalid}
+	if !invalid && net.ParseIP(host) != nil {
+		// An IP address is not sent as SNI, so the handshake does not tell
+		// which address the certificate must be checked against
+		key.ip = host
+	}
+	if key.cert == nil && key.ip == "" {
+		return base
+	}
+
+	transports.mu.Lock()
+	defer transports.mu.Unlock()
+
+	// Connections opened with a removed or replaced certificate are dropped
+	generation := clientcert.Generation()
+	if generation != transports.generation || len(transports.transports) >= maxTransports {
+		for _, t := range transports.transports {
+			t.CloseIdleConnections()
+		}
+		transports.transports = make(map[transportKey]*http.Transport)
+		transports.generation = generation
+	}
+
+	if t, ok := transports.transports[key]; ok {
+		return t
+	}
+	t := base.Clone()
+	if c != nil {
+		t.TLSClientConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return c.Certificate(), nil
+		}
+	}
+	if key.ip != "" {
+		ip := key.ip
+		t.TLSClientConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			return verifyUpstream(state, ip)
+		}
+	}
+	transports.transports[key] = t
+	return t
+}
@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// serveHTTP2 serves the streams of an h2 connection concurrently. Each
+// stream goes through processRequest, whose HTTP/1.1 output is parsed back
+// and written to the stream. reflected tells that the client accepted an
+// invalid certificate for the server.
+func serveHTTP2(tlsConn net.Conn, hostport string, reflected bool) {
+	server := &http2.Server{}
+	server.ServeConn(tlsConn, &http2.ServeConnOpts{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			req.Host = hostport
+			if reflected {
+				req = acceptInvalid(req)
+			}
+			serveStream(w, req, tlsConn)
+		}),
+	})
+}
+
+func serveStream(w http.ResponseWriter, req *http.Request, tlsConn net.Conn) {
+	reader, writer := io.Pipe()
+	stream := &streamConn{Conn: tlsConn, writer: writer}
+	go func() {
+		processRequest(stream, req, true)
+		writer.Close()
+	}()
+	defer reader.Close() // Unblocks processRequest if the client goes away
+
+	// Informational responses precede the final one. The HTTP/2 server
+	// sends 100 Continue by itself when the body is read.
+	buffered := bufio.NewReader(reader)
+	var resp *http.Response
+	for {
+		var err error
+		resp, err = http.ReadResponse(buffered, req)
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("Erreur lecture réponse HTTP/2: %v", err)
+			}
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		if resp.StatusCode >= 200 || resp.StatusCode == http.StatusSwitchingProtocols {
+			break
+		}
+		if resp.StatusCode != http.StatusContinue {
+			copyHeader(w.Header(), resp.Header)
+			w.WriteHeader(resp.StatusCode)
+		}
+	}
+	defer resp.Body.Close()
+
+	// Connection-specific headers are forbidden in HTTP/2
+	header := w.Header()
+	for key := range header {
+		header.Del(key)
+	}
+	copyHeader(header, resp.Header)
+	for key := range resp.Trailer {
+		header.Add("Trailer", key)
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	// Forward streamed bodies as they arrive
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, writeErr := w.Write(buf[:n]); writeErr != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	// Only known once the body has been read
+	for key, values := range resp.Trailer {
+		header[http.TrailerPrefix+key] = values
+	}
+}
+
+// copyHeader copies a response header without its hop-by-hop headers
+func copyHeader(dst http.Header, src http.Header) {
+	for key, values := range responseHeader(src) {
+		dst[key] = values
+	}
+}
+
+// streamConn is the connection processRequest writes an HTTP/2 stream's
+// response to. Reading is never needed since the request is already parsed.
+type streamConn struct {
+	net.Conn
+	writer *io.PipeWriter
+}
+
+func (c *streamConn) Read(p []byte) (int, error)         { return 0, io.EOF }
+func (c *streamConn) Write(p []byte) (int, error)        { return c.writer.Write(p) }
+func (c *streamConn) Close() error                       { return c.writer.Close() }
+func (c *streamConn) SetDeadline(t time.Time) error      { return nil }
+func (c *streamConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *streamConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,45 @@
+package proxy
+
+import (
+	"bufio"
+	"log"
+	"net"
+	"proxy-interceptor/config"
+	"strconv"
+)
+
+// startInvisible listens for clients that are not proxy-aware and were sent
+// to ShackoDodo by /etc/hosts or a firewall redirection. TLS connections are
+// routed by their SNI to port 443, plain HTTP by its Host header.
+func startInvisible(port int) {
+	go func() {
+		cfg := config.GetInstance()
+		addr := net.JoinHostPort(cfg.ProxyAddress, strconv.Itoa(port))
+
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			log.Fatalf("Erreur lors du démarrage du proxy invisible: %v", err)
+		}
+		defer listener.Close()
+
+		log.Printf("Proxy invisible en attente de connexions sur %s...", addr)
+
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				log.Printf("Erreur lors de l'acceptation de la connexion: %v", err)
+				continue
+			}
+
+			go handleInvisible(conn)
+		}
+	}()
+}
+
+// handleInvisible serves a direct connection whose destination is unknown
+func handleInvisible(clientConn net.Conn) {
+	defer clientConn.Close()
+
+	reader := bufio.NewReaderSize(clientConn, maxRecordSize)
+	handleStream(&peekedConn{Conn: clientConn, reader: reader}, reader, "")
+}
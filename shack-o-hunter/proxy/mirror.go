@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net"
+	"proxy-interceptor/cert"
+	"proxy-interceptor/config"
+	"time"
+)
+
+// leafCertificate returns the certificate presented to the client for name.
+// With CertMirror the upstream server is dialed first to copy its
+// certificate, falling back to a plain certificate if it cannot be reached.
+func leafCertificate(name string, hostport string) (*tls.Certificate, error) {
+	if config.GetInstance().CertMirror {
+		tlsCert, err := cert.MirrorCertForHost(name, func() (*x509.Certificate, error) {
+			chain, err := upstreamChain(hostport, name)
+			if err != nil {
+				return nil, err
+			}
+			return chain[0], nil
+		})
+		if err == nil {
+			return tlsCert, nil
+		}
+		log.Printf("Certificat amont de %s non copié: %v", name, err)
+	}
+	return cert.GenerateCertForHost(name)
+}
+
+// upstreamChain dials hostport and returns the chain the server presents
+// for serverName, leaf first
+func upstreamChain(hostport string, serverName string) ([]*x509.Certificate, error) {
+	if _, _, err := net.SplitHostPort(hostport); err != nil {
+		hostport = net.JoinHostPort(hostport, "443")
+	}
+	conn, err := dialUpstream(hostport)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	// Only the certificates are wanted, the caller decides whether to trust them
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificate presented")
+	}
+	return certs, nil
+}
@@ -0,0 +1,225 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"proxy-interceptor/cert"
+	"proxy-interceptor/config"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/google/uuid"
+	"github.com/skip2/go-qrcode"
+)
+
+// isOnboardingHost tells whether hostport is the magic host answered by the
+// proxy itself, e.g. http://shackododo/
+func isOnboardingHost(hostport string) bool {
+	magic := config.GetInstance().OnboardingHost
+	if magic == "" {
+		return false
+	}
+	host := strings.TrimSuffix(newTarget("http", hostport, "").Host, ".")
+	return strings.EqualFold(host, magic)
+}
+
+// serveOnboarding answers a request to the magic host with the page helping
+// to set up a device: the CA in several formats and a QR code of the proxy
+// address. It returns whether the connection can be reused.
+func serveOnboarding(clientConn net.Conn, req *http.Request) bool {
+	if req.Body != nil {
+		io.Copy(io.Discard, req.Body)
+		req.Body.Close()
+	}
+	log.Printf("Page d'installation du CA: %s %s", req.Method, req.URL.Path)
+
+	status := http.StatusOK
+	contentType := ""
+	header := http.Header{}
+	var body []byte
+	var err error
+	ca := cert.CACertificate()
+	switch {
+	case req.Method != http.MethodGet && req.Method != http.MethodHead:
+		status = http.StatusMethodNotAllowed
+		header.Set("Allow", "GET, HEAD")
+	case ca == nil:
+		err = fmt.Errorf("CA not initialized")
+	case req.URL.Path == "/" || req.URL.Path == "/index.html":
+		contentType = "text/html; charset=utf-8"
+		body, err = onboardingPage(proxyAddress(clientConn))
+	case req.URL.Path == "/shackododo-ca.pem":
+		contentType = "application/x-pem-file"
+		body, err = cert.ExportCA("pem", "")
+	case req.URL.Path == "/shackododo-ca.crt":
+		// The type Android and iOS install as a CA certificate
+		contentType = "application/x-x509-ca-cert"
+		body, err = cert.ExportCA("der", "")
+	case req.URL.Path == "/shackododo.mobileconfig":
+		contentType = "application/x-apple-aspen-config"
+		body, err = mobileConfig()
+	case req.URL.Path == "/qr.png":
+		contentType = "image/png"
+		body, err = qrcode.Encode(proxyAddress(clientConn), qrcode.Medium, 256)
+	default:
+		status = http.StatusNotFound
+	}
+	if err != nil {
+		log.Printf("Erreur page d'installation du CA: %v", err)
+		status = http.StatusInternalServerError
+		contentType = ""
+		body = nil
+	}
+
+	if body == nil {
+		contentType = "text/plain; charset=utf-8"
+		body = []byte(http.StatusText(status) + "\n")
+	}
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Length", strconv.Itoa(len(body))) // Also answers HEAD
+	header.Set("Cache-Control", "no-store")
+	if status == http.StatusOK && strings.HasPrefix(req.URL.Path, "/shackododo") {
+		header.Set("Content-Disposition", "attachment; filename=\""+req.URL.Path[1:]+"\"")
+	}
+	resp := &http.Response{
+		StatusCode:    status,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+	_, keepAlive, err := writeResponse(clientConn, req, resp, !req.Close)
+	return err == nil && keepAlive
+}
+
+// proxyAddress is the HTTP proxy's address on the interface the client
+// reached, which is the one a device on the same network must configure
+func proxyAddress(clientConn net.Conn) string {
+	cfg := config.GetInstance()
+	host := cfg.ProxyAddress
+	if addr, ok := clientConn.LocalAddr().(*net.TCPAddr); ok && !addr.IP.IsUnspecified() {
+		host = addr.IP.String()
+	}
+	return net.JoinHostPort(host, strconv.Itoa(cfg.ProxyPort))
+}
+
+var onboardingTemplate = htmltemplate.Must(htmltemplate.New("onboarding").Parse(`<!DOCTYPE html>
+<html lang="fr">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>ShackoDodo - Installation du certificat CA</title>
+<style>
+body { font-family: sans-serif; max-width: 40em; margin: 2em auto; padding: 0 1em; line-height: 1.5; }
+code { word-break: break-all; }
+a.download { display: inline-block; margin: 0 .5em .5em 0; padding: .5em 1em; border: 1px solid #888; border-radius: 4px; text-decoration: none; }
+</style>
+</head>
+<body>
+<h1>ShackoDodo</h1>
+
+<h2>1. Configurer le proxy</h2>
+<p>Proxy HTTP/HTTPS : <strong>{{.Proxy}}</strong></p>
+<img src="/qr.png" width="256" height="256" alt="{{.Proxy}}">
+
+<h2>2. Installer le certificat CA</h2>
+<p>
+<a class="download" href="/shackododo-ca.crt">Android, Windows (DER)</a>
+<a class="download" href="/shackododo.mobileconfig">iOS, macOS (profil)</a>
+<a class="download" href="/shackododo-ca.pem">Linux, Firefox (PEM)</a>
+</p>
+<p>{{.Name}}<br>SHA-256 : <code>{{.Fingerprint}}</code></p>
+
+<ul>
+<li>Android : Paramètres &gt; Sécurité &gt; Chiffrement et identifiants &gt; Installer un certificat &gt; Certificat CA.</li>
+<li>iOS : installez le profil dans Réglages, puis activez la confiance totale dans Réglages &gt; Général &gt; Informations &gt; Réglages des certificats.</li>
+<li>Firefox utilise son propre magasin : Paramètres &gt; Vie privée et sécurité &gt; Certificats &gt; Importer.</li>
+</ul>
+</body>
+</html>
+`))
+
+// onboardingPage renders the page for a client reaching the proxy at proxy
+func onboardingPage(proxy string) ([]byte, error) {
+	ca := cert.CACertificate()
+	sum := sha256.Sum256(ca.Raw)
+	fingerprint := make([]string, len(sum))
+	for i, b := range sum {
+		fingerprint[i] = fmt.Sprintf("%02X", b)
+	}
+
+	var page bytes.Buffer
+	err := onboardingTemplate.Execute(&page, struct {
+		Proxy       string
+		Name        string
+		Fingerprint string
+	}{proxy, ca.Subject.CommonName, strings.Join(fingerprint, ":")})
+	return page.Bytes(), err
+}
+
+var mobileConfigTemplate = template.Must(template.New("mobileconfig").Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>PayloadContent</key>
+	<array>
+		<dict>
+			<key>PayloadCertificateFileName</key>
+			<string>shackododo-ca.crt</string>
+			<key>PayloadContent</key>
+			<data>{{.Certificate}}</data>
+			<key>PayloadDisplayName</key>
+			<string>{{html .Name}}</string>
+			<key>PayloadIdentifier</key>
+			<string>com.shackododo.ca.{{.CertUUID}}</string>
+			<key>PayloadType</key>
+			<string>com.apple.security.root</string>
+			<key>PayloadUUID</key>
+			<string>{{.CertUUID}}</string>
+			<key>PayloadVersion</key>
+			<integer>1</integer>
+		</dict>
+	</array>
+	<key>PayloadDescription</key>
+	<string>Certificat CA du proxy ShackoDodo</string>
+	<key>PayloadDisplayName</key>
+	<string>{{html .Name}}</string>
+	<key>PayloadIdentifier</key>
+	<string>com.shackododo.profile.{{.ProfileUUID}}</string>
+	<key>PayloadType</key>
+	<string>Configuration</string>
+	<key>PayloadUUID</key>
+	<string>{{.ProfileUUID}}</string>
+	<key>PayloadVersion</key>
+	<integer>1</integer>
+</dict>
+</plist>
+`))
+
+// mobileConfig builds an Apple configuration profile installing the CA. Its
+// UUIDs derive from the certificate, so a rotated CA is a new profile.
+func mobileConfig() ([]byte, error) {
+	ca := cert.CACertificate()
+	profileUUID := uuid.NewSHA1(uuid.NameSpaceOID, ca.Raw)
+
+	var profile bytes.Buffer
+	err := mobileConfigTemplate.Execute(&profile, struct {
+		Certificate string
+		Name        string
+		ProfileUUID string
+		CertUUID    string
+	}{
+		Certificate: base64.StdEncoding.EncodeToString(ca.Raw),
+		Name:        ca.Subject.CommonName,
+		ProfileUUID: strings.ToUpper(profileUUID.String()),
+		CertUUID:    strings.ToUpper(uuid.NewSHA1(profileUUID, []byte("root")).String()),
+	})
+	return profile.Bytes(), err
+}
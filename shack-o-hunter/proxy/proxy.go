@@ -5,115 +5,245 @@ import (
 	"bytes"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
 	"net/url"
 	"proxy-interceptor/cert"
 	"proxy-interceptor/config"
+	"proxy-interceptor/content"
+	"proxy-interceptor/history"
+	"proxy-interceptor/rules"
+	"proxy-interceptor/scope"
+	"proxy-interceptor/upstream"
 	"proxy-interceptor/websocket"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
 )
 
-var directClient = &http.Client{
-	Transport: &http.Transport{
-		Proxy: nil, // IMPORTANT: never proxy the outbound (avoid loops)
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: true,
+var directTransport = &http.Transport{
+	Proxy: upstreamProxy, // IMPORTANT: never the system proxy (avoid loops), only the configured upstream
+	TLSClientConfig: &tls.Config{
+		// Certificates are checked by verifyUpstream, which applies the
+		// per-host policy that the standard verification lacks. Servers
+		// reached by IP address are checked by a transport of their own,
+		// see transportFor.
+		InsecureSkipVerify: true,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			return verifyUpstream(state, state.ServerName)
 		},
 	},
-	Timeout: 30 * time.Second,
+	DisableCompression: true, // Bodies are forwarded as the server sent them and decoded for display only
+
+	// Only connecting and waiting for the headers are bounded: bodies may be
+	// large downloads or never end, e.g. server-sent events
+	DialContext:           (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+	TLSHandshakeTimeout:   15 * time.Second,
+	ResponseHeaderTimeout: 60 * time.Second,
+	IdleConnTimeout:       90 * time.Second,
+}
+
+var directClient = &http.Client{
+	Transport: upstreamTransport{},
 	CheckRedirect: func(req *http.Request, via []*http.Request) error {
 		return http.ErrUseLastResponse // Don't follow redirects
 	},
 }
 
-// shouldFilterDomain returns true if the domain should be filtered (not logged/sent)
-func shouldFilterDomain(host string) bool {
-	host = strings.ToLower(host)
+// upstreamProxy returns the upstream proxy routing the request's host, if any
+func upstreamProxy(req *http.Request) (*url.URL, error) {
+	return config.GetInstance().GetUpstream().ProxyFor(req.URL.Hostname())
+}
+
+// DirectClient returns the client used to send intercepted requests upstream
+func DirectClient() *http.Client {
+	return directClient
+}
 
-	mozillaFirefoxDomains := []string{
-		"mozilla.com",
-		"mozilla.org",
-		"mozilla.net",
-		"firefox.com",
-		"firefox.org",
-		"getpocket.com",
-		"firefoxusercontent.com",
-		"services.mozilla.com",
+// mozillaDomains are Firefox background services, hidden when FilterMozilla is set
+var mozillaDomains = []string{
+	".mozilla.com",
+	".mozilla.org",
+	".mozilla.net",
+	".firefox.com",
+	".firefox.org",
+	".getpocket.com",
+	".firefoxusercontent.com",
+}
+
+// checkScope returns how traffic to the given target must be handled
+func checkScope(target scope.Target) scope.Decision {
+	decision := evaluateScope(target)
+
+	// Clients would refuse a certificate outside the CA's name constraints,
+	// the connection is tunneled instead
+	if decision.MITM && !cert.Permits(target.Host) {
+		decision.MITM = false
 	}
+	return decision
+}
 
-	for _, domain := range mozillaFirefoxDomains {
-		if strings.Contains(host, domain) {
-			return true
+func evaluateScope(target scope.Target) scope.Decision {
+	cfg := config.GetInstance()
+	if cfg.FilterMozilla {
+		for _, domain := range mozillaDomains {
+			if scope.MatchHost(domain, target.Host) {
+				return scope.Decision{MITM: true}
+			}
 		}
 	}
+	return cfg.GetScope().Evaluate(target)
+}
 
-	return false
+// newTarget builds a scope target from a "host[:port]" authority
+func newTarget(scheme string, hostport string, path string) scope.Target {
+	target := scope.Target{Host: hostport, Scheme: scheme, Path: path, Port: 80}
+	if scheme == "https" {
+		target.Port = 443
+	}
+	if host, port, err := net.SplitHostPort(hostport); err == nil {
+		target.Host = host
+		if p, err := strconv.Atoi(port); err == nil {
+			target.Port = p
+		}
+	}
+	return target
 }
 
 // handleConnection handles each incoming connection
 func handleConnection(clientConn net.Conn) {
 	defer clientConn.Close()
+	serveHTTP(clientConn, bufio.NewReader(clientConn), "")
+}
 
-	// Read the first request
-	reader := bufio.NewReader(clientConn)
-	req, err := http.ReadRequest(reader)
-	if err != nil {
-		log.Printf("Erreur lors de la lecture de la requête: %v", err)
-		return
-	}
+// serveHTTP reads requests in a loop so that keep-alive connections are
+// honoured. defaultHost is used for requests without a Host header, e.g.
+// when the destination is already known from a SOCKS handshake.
+func serveHTTP(clientConn net.Conn, reader *bufio.Reader, defaultHost string) {
+	for {
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			if !isClosedConnError(err) {
+				log.Printf("Erreur lors de la lecture de la requête: %v", err)
+			}
+			return
+		}
+		if req.Host == "" {
+			req.Host = defaultHost
+		}
+		if req.Host == "" {
+			clientConn.Write([]byte("HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"))
+			return
+		}
 
-	// Check if domain should be filtered before logging
-	host := req.Host
-	if strings.Contains(host, ":") {
-		host = strings.Split(host, ":")[0]
-	}
-	shouldFilter := shouldFilterDomain(host)
+		// The magic host is answered by the proxy, never sent upstream
+		if req.Method != http.MethodConnect && isOnboardingHost(req.Host) {
+			if !serveOnboarding(clientConn, req) {
+				return
+			}
+			continue
+		}
 
-	// Log the request only if not filtered
-	if !shouldFilter {
-		log.Printf("Requête: %s %s %s", req.Method, req.Host, req.URL.Path)
-	}
+		// Check the scope before logging
+		var decision scope.Decision
+		if req.Method == http.MethodConnect {
+			decision = checkScope(newTarget("https", req.Host, ""))
+		} else {
+			decision = checkScope(newTarget("http", req.Host, req.URL.Path))
+		}
 
-	// Handle CONNECT method for HTTPS tunneling
-	if req.Method == http.MethodConnect {
-		handleHTTPS(clientConn, req)
-		return
+		// Log the request only if in the logged scope
+		if decision.Log {
+			log.Printf("Requête: %s %s %s", req.Method, req.Host, req.URL.Path)
+		}
+
+		// Handle CONNECT method for HTTPS tunneling
+		if req.Method == http.MethodConnect {
+			handleHTTPS(clientConn, req)
+			return
+		}
+
+		// Handle regular HTTP requests
+		if !handleHTTP(clientConn, req) {
+			return
+		}
 	}
+}
 
-	// Handle regular HTTP requests
-	handleHTTP(clientConn, req)
+// isClosedConnError returns true for errors caused by the client closing an
+// idle keep-alive connection, which are expected and not worth logging
+func isClosedConnError(err error) bool {
+	if err == io.EOF || errors.Is(err, net.ErrClosed) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return strings.Contains(err.Error(), "connection reset by peer")
 }
 
 // handleHTTPS handles HTTPS CONNECT requests with MITM interception
 func handleHTTPS(clientConn net.Conn, req *http.Request) {
-	host := req.Host
-	if strings.Contains(host, ":") {
-		host = strings.Split(host, ":")[0]
-	}
-
-	shouldFilter := shouldFilterDomain(host)
+	decision := checkScope(newTarget("https", req.Host, ""))
+	shouldFilter := !decision.Log
 	if !shouldFilter {
 		log.Printf("CONNECT: %s", req.Host)
 	}
 
-	clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
-
-	tlsCert, err := cert.GenerateCertForHost(host)
-	if err != nil {
-		log.Printf("Erreur génération certificat pour %s: %v", host, err)
+	// Out-of-scope hosts can be relayed without decrypting them
+	if !decision.MITM {
+		tunnel(clientConn, req.Host)
 		return
 	}
 
+	clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+
+	// Tunnels usually carry TLS, but plain HTTP (e.g. ws:// through a proxy)
+	// and other protocols are handled too
+	reader := bufio.NewReaderSize(clientConn, maxRecordSize)
+	handleStream(&peekedConn{Conn: clientConn, reader: reader}, reader, req.Host)
+}
+
+// interceptTLS terminates the client's TLS connection with a certificate
+// for the SNI name, or the target host without SNI, and serves every request
+// sent inside to hostport
+func interceptTLS(clientConn net.Conn, hostport string, logged bool) {
+	host := newTarget("https", hostport, "").Host
+
+	// Set when the server's certificate is refused and the client is shown
+	// an invalid one instead: if it goes on, the server is not verified
+	reflected := false
 	tlsConfig := &tls.Config{
-		Certificates: []tls.Certificate{*tlsCert},
-		MinVersion:   tls.VersionTLS12,
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			name := hello.ServerName
+			if name == "" {
+				name = host
+			}
+			if reason := invalidUpstream(name, hostport); reason != "" {
+				log.Printf("Certificat invalide de %s présenté au client: %s", name, reason)
+				reflected = true
+				return cert.InvalidCertForHost(name)
+			}
+			tlsCert, err := leafCertificate(name, hostport)
+			if err != nil {
+				log.Printf("Erreur génération certificat pour %s: %v", name, err)
+			}
+			return tlsCert, err
+		},
+		MinVersion: tls.VersionTLS12,
+	}
+	if !config.GetInstance().ForceHTTP1 {
+		tlsConfig.NextProtos = []string{"h2", "http/1.1"}
 	}
 
 	tlsClientConn := tls.Server(clientConn, tlsConfig)
@@ -123,30 +253,69 @@ func handleHTTPS(clientConn net.Conn, req *http.Request) {
 	}
 	defer tlsClientConn.Close()
 
-	if !shouldFilter {
-		log.Printf("HTTPS interception established for: %s", req.Host)
+	if logged {
+		log.Printf("HTTPS interception established for: %s (%s)", hostport, tlsClientConn.ConnectionState().NegotiatedProtocol)
 	}
 
-	reader := bufio.NewReader(tlsClientConn)
-	httpsReq, err := http.ReadRequest(reader)
-	if err != nil {
-		log.Printf("Erreur lecture requête HTTPS: %v", err)
+	if tlsClientConn.ConnectionState().NegotiatedProtocol == "h2" {
+		serveHTTP2(tlsClientConn, hostport, reflected)
 		return
 	}
 
-	httpsReq.Host = req.Host
+	// Serve every request sent through the tunnel until the client closes it
+	reader := bufio.NewReader(tlsClientConn)
+	for {
+		httpsReq, err := http.ReadRequest(reader)
+		if err != nil {
+			if !isClosedConnError(err) {
+				log.Printf("Erreur lecture requête HTTPS: %v", err)
+			}
+			return
+		}
+
+		httpsReq.Host = hostport
+		if reflected {
+			httpsReq = acceptInvalid(httpsReq)
+		}
 
-	processRequest(tlsClientConn, httpsReq, true)
+		if !processRequest(tlsClientConn, httpsReq, true) {
+			return
+		}
+	}
 }
 
-// processRequest handles the common logic for both HTTP and HTTPS requests
-func processRequest(clientConn net.Conn, req *http.Request, isHTTPS bool) {
+// processRequest handles the common logic for both HTTP and HTTPS requests.
+// It returns true when the client connection can be reused for another request.
+func processRequest(clientConn net.Conn, req *http.Request, isHTTPS bool) bool {
+	startedAt := time.Now()
+
+	// The client waits for this before sending the body
+	if req.ProtoAtLeast(1, 1) && req.ContentLength != 0 && strings.EqualFold(req.Header.Get("Expect"), "100-continue") {
+		if err := writeInformational(clientConn, http.StatusContinue, nil); err != nil {
+			return false
+		}
+	}
+
+	// The body must be fully consumed before the next request can be read.
+	// Bodies above the memory limit are streamed to the server instead.
 	var body []byte
+	var streamed *spool
 	if req.Body != nil {
-		body, _ = io.ReadAll(req.Body)
-		req.Body.Close()
+		var err error
+		body, streamed, err = readBody(req.Body)
+		if streamed == nil {
+			req.Body.Close()
+		}
+		if err != nil {
+			log.Printf("Erreur lors de la lecture du corps de la requête: %v", err)
+			return false
+		}
 	}
 
+	// req.Close is set for "Connection: close" and for HTTP/1.0 without keep-alive.
+	// A streamed body may be left unread if the server answers early.
+	keepAlive := !req.Close && streamed == nil
+
 	fullURL := req.URL.String()
 	if isHTTPS {
 		fullURL = "https://" + req.Host + req.URL.Path
@@ -167,12 +336,34 @@ func processRequest(clientConn net.Conn, req *http.Request, isHTTPS bool) {
 		fullURL = req.URL.String()
 	}
 
-	// Check if domain should be filtered
-	host := req.Host
-	if strings.Contains(host, ":") {
-		host = strings.Split(host, ":")[0]
+	// Compressed bodies are shown, matched and edited decoded
+	var coding codedBody
+	if streamed == nil {
+		body, coding = decodeBody(req.Header, body)
+	}
+
+	// Apply match-and-replace rules before the request is shown or sent.
+	// Body rules cannot apply to a streamed body.
+	ruleRequest := rules.Request{Method: req.Method, URL: fullURL, Header: req.Header, Body: body}
+	if streamed != nil {
+		ruleRequest.Body = nil
+	}
+	rules.ApplyRequest(&ruleRequest)
+	fullURL = ruleRequest.URL
+	if streamed == nil {
+		body = ruleRequest.Body
+	}
+
+	// Check if the request is in scope
+	scheme := "http"
+	if isHTTPS || req.URL.Scheme == "https" {
+		scheme = "https"
 	}
-	shouldFilter := shouldFilterDomain(host)
+	target := newTarget(scheme, req.Host, req.URL.Path)
+	host := target.Host
+	decision := checkScope(target)
+	shouldFilter := !decision.Log
+	intercept := decision.Intercept
 
 	if !shouldFilter {
 		log.Printf("Request: %s %s", req.Method, fullURL)
@@ -180,23 +371,49 @@ func processRequest(clientConn net.Conn, req *http.Request, isHTTPS bool) {
 		log.Printf("Request: %s %s", req.Method, fullURL)
 	}
 
-	if !shouldFilter {
-		requestID := uuid.New().String()
+	requestID := uuid.New().String()
+
+	// Out-of-scope requests are neither broadcast nor recorded in the history
+	var entry *history.Entry
 
+	if !shouldFilter {
 		// Vérifier si la pause est activée via la config
+		// A streamed body is already on its way and cannot be edited
 		cfg := config.GetInstance()
+		paused := cfg.Pause && intercept && streamed == nil
 		status := "passthrough"
-		if cfg.Pause {
+		if paused {
 			status = "pending"
 		}
 
+		entry = &history.Entry{
+			ID:             requestID,
+			StartedAt:      startedAt,
+			Method:         req.Method,
+			URL:            fullURL,
+			Host:           host,
+			ClientProtocol: req.Proto,
+			RequestHeaders: req.Header.Clone(),
+			Status:         status,
+		}
+
 		requestData := websocket.RequestData{
 			Method:  req.Method,
 			URL:     fullURL,
 			Headers: req.Header,
-			Body:    string(body),
 			Status:  status,
 		}
+		requestData.Body, requestData.BodyInfo = uiBody(body, streamed != nil, req.ContentLength)
+		coding.describe(&requestData.BodyInfo)
+		if streamed == nil {
+			entry.SetRequestBody(body)
+		} else {
+			entry.RequestBody, entry.RequestBodyInfo = previewBody(body, req.ContentLength)
+			// An upgraded connection is recorded without waiting for the body
+			if !isWebSocketUpgrade(req) {
+				streamed.keep()
+			}
+		}
 
 		message := websocket.Message{
 			Type: "request",
@@ -211,9 +428,12 @@ func processRequest(clientConn net.Conn, req *http.Request, isHTTPS bool) {
 			websocket.BroadcastChannel <- jsonData
 		}
 
-		if cfg.Pause {
+		if paused {
 			// Mode pause activé - attendre une modification
-			modification, hasModification := websocket.WaitForModification(requestID, 30*time.Second)
+			blockedAt := time.Now()
+			modification, hasModification := websocket.WaitForModification(requestID, time.Duration(cfg.PauseTimeout))
+			entry.Timings.Blocked = milliseconds(time.Since(blockedAt))
+			entry.Status = "sent"
 
 			if hasModification {
 				switch modification.Action {
@@ -228,68 +448,427 @@ func processRequest(clientConn net.Conn, req *http.Request, isHTTPS bool) {
 						}
 					}
 					if modification.Body != "" {
-						body = []byte(modification.Body)
+						if decoded, err := content.Decode(modification.Body, modification.Encoding); err == nil {
+							body = decoded
+							if modification.SendRaw {
+								coding = codedBody{}
+							}
+						} else {
+							log.Printf("Corps modifié ignoré: %v", err)
+						}
 					}
 					for k, v := range modification.Headers {
 						req.Header[k] = v
 					}
 				case "drop":
+					entry.Status = "dropped"
+					history.Save(entry)
 					clientConn.Write([]byte("HTTP/1.1 204 No Content\r\n\r\n"))
-					return
+					return keepAlive
 				}
 			}
+
+			// Record the request as it was actually sent
+			entry.Method = req.Method
+			entry.URL = fullURL
+			entry.RequestHeaders = req.Header.Clone()
+			entry.SetRequestBody(body)
 		}
 		// Si pause n'est pas activé, la requête continue directement sans attendre
 	}
 
-	proxyReq, err := http.NewRequest(req.Method, fullURL, bytes.NewReader(body))
+	// An edited body is compressed again like the original
+	wire, wireCoding := coding.encode(req.Header, body)
+	if entry != nil && wireCoding != "" {
+		entry.RequestBodyInfo.SetRaw(wire, wireCoding)
+	}
+
+	// saveEntry records the exchange. The transport closes a streamed
+	// request body once sent, even on errors.
+	saveEntry := func() {
+		if streamed != nil {
+			if recorder := streamed.record(); recorder != nil {
+				entry.SetStreamedRequestBody(recorder)
+			}
+		}
+		history.Save(entry)
+	}
+
+	var outgoing io.Reader = bytes.NewReader(wire)
+	if streamed != nil {
+		outgoing = streamed
+	}
+	proxyReq, err := http.NewRequest(req.Method, fullURL, outgoing)
 	if err != nil {
 		log.Printf("Erreur lors de la création de la requête: %v", err)
-		clientConn.Write([]byte("HTTP/1.1 500 Internal Server Error\r\n\r\n"))
-		return
+		if streamed != nil {
+			streamed.Close()
+		}
+		if entry != nil {
+			entry.Error = err.Error()
+			saveEntry()
+		}
+		clientConn.Write([]byte("HTTP/1.1 500 Internal Server Error\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"))
+		return false
+	}
+	if streamed != nil {
+		proxyReq.ContentLength = req.ContentLength
 	}
 
+	if clientHost, ok := req.Context().Value(clientHostKey{}).(string); ok {
+		proxyReq.Host = clientHost
+	}
+	if acceptsInvalid(req) {
+		proxyReq = acceptInvalid(proxyReq)
+	}
+
+	// Servers requiring mutual TLS get the certificate registered for their host
+	proxyReq, clientCert := withClientCert(proxyReq)
+	if entry != nil && clientCert != nil {
+		entry.ClientCert = clientCert.Name
+	}
 	proxyReq.Header = req.Header.Clone()
 	proxyReq.Header.Del("Proxy-Connection")
 	proxyReq.Header.Del("Connection")
 
-	resp, err := directClient.Do(proxyReq)
+	// Compressed frames could be neither shown nor edited
+	upgrade := isWebSocketUpgrade(req)
+	if upgrade {
+		proxyReq.Header.Set("Connection", "Upgrade")
+		proxyReq.Header.Del("Sec-WebSocket-Extensions")
+	}
+
+	// Measure when the request has been written to split send and wait times
+	sendStart := time.Now()
+	var wroteRequest atomic.Int64
+	wroteRequest.Store(sendStart.UnixNano())
+	proxyReq = proxyReq.WithContext(httptrace.WithClientTrace(proxyReq.Context(), &httptrace.ClientTrace{
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			wroteRequest.Store(time.Now().UnixNano())
+		},
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			// 100 Continue has already been sent to the client, if it asked
+			if code == http.StatusContinue || !req.ProtoAtLeast(1, 1) {
+				return nil
+			}
+			return writeInformational(clientConn, code, http.Header(header))
+		},
+	}))
+
+	// The client timeout would cut the upgraded connection, whose body is the stream
+	var resp *http.Response
+	if upgrade {
+		resp, err = directClient.Transport.RoundTrip(proxyReq)
+	} else {
+		resp, err = directClient.Do(proxyReq)
+	}
 	if err != nil {
 		log.Printf("Erreur lors de l'envoi de la requête: %v", err)
-		clientConn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
-		return
+
+		// A refused certificate is explained to the user rather than
+		// leaving an empty error page
+		var message string
+		var tlsInfo *history.TLSInfo
+		var verr *verifyError
+		if errors.As(err, &verr) {
+			message = verr.Error() + "\n"
+			tlsInfo = verr.info
+		}
+		if entry != nil {
+			entry.Error = err.Error()
+			entry.UpstreamTLS = tlsInfo
+			saveEntry()
+			broadcastResponse(requestID, websocket.ResponseData{
+				StatusCode:  http.StatusBadGateway,
+				Headers:     map[string][]string{},
+				UpstreamTLS: tlsInfo,
+				Error:       err.Error(),
+			})
+		}
+		fmt.Fprintf(clientConn, "HTTP/1.1 502 Bad Gateway\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", len(message), message)
+		return false
 	}
 	defer resp.Body.Close()
 
-	if !shouldFilter {
-		log.Printf("Response: %d %s", resp.StatusCode, resp.Status)
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		relayWebSocket(clientConn, resp, entry, intercept)
+		return false
 	}
 
-	clientConn.Write([]byte(fmt.Sprintf("HTTP/%d.%d %d %s\r\n",
-		resp.ProtoMajor, resp.ProtoMinor, resp.StatusCode, resp.Status)))
+	// A response body above the memory limit is recorded while it is copied
+	var streamedResp *spool
+	receiveStart := time.Now()
+
+	if !shouldFilter {
+		log.Printf("Response: %s", resp.Status)
+
+		wroteAt := time.Unix(0, wroteRequest.Load())
+		entry.Timings.Send = milliseconds(wroteAt.Sub(sendStart))
+		entry.Timings.Wait = milliseconds(time.Since(wroteAt))
+		if resp.TLS != nil {
+			entry.UpstreamTLS = describeTLS(resp.TLS, proxyReq.URL.Hostname())
+			entry.UpstreamTLS.Reflected = acceptsInvalid(req) && !entry.UpstreamTLS.Verified
+		}
 
-	for key, values := range resp.Header {
-		for _, value := range values {
-			clientConn.Write([]byte(fmt.Sprintf("%s: %s\r\n", key, value)))
+		// Server-sent events never end and are forwarded as they arrive
+		receiveStart = time.Now()
+		var respBody []byte
+		var spooled *spool
+		if isEventStream(resp.Header) {
+			spooled = newSpool(nil, resp.Body)
+		} else {
+			respBody, spooled, err = readBody(resp.Body)
 		}
+		if err != nil {
+			log.Printf("Erreur lors de la lecture de la réponse: %v", err)
+			entry.Error = err.Error()
+		}
+
+		if spooled != nil {
+			// Neither paused nor edited, only header and status rules apply
+			spooled.keep()
+			streamedResp = spooled
+			resp.Body = spooled
+			applyResponseRules(req.Method, fullURL, resp, nil)
+
+			responseData := websocket.ResponseData{
+				StatusCode:  resp.StatusCode,
+				Headers:     resp.Header,
+				Status:      "passthrough",
+				UpstreamTLS: entry.UpstreamTLS,
+			}
+			responseData.Body, responseData.BodyInfo = uiBody(respBody, true, resp.ContentLength)
+			broadcastResponse(requestID, responseData)
+
+			entry.StatusCode = resp.StatusCode
+			entry.Protocol = resp.Proto
+			entry.ResponseHeaders = resp.Header.Clone()
+			entry.ResponseBody, entry.ResponseBodyInfo = previewBody(respBody, resp.ContentLength)
+			entry.ContentType = resp.Header.Get("Content-Type")
+		} else {
+			resp.Body.Close()
+			entry.Timings.Receive = milliseconds(time.Since(receiveStart))
+
+			respBody, respCoding := decodeBody(resp.Header, respBody)
+			respBody = applyResponseRules(req.Method, fullURL, resp, respBody)
+			respBody, forward := interceptResponse(requestID, resp, respBody, &respCoding, entry.UpstreamTLS, intercept)
+
+			// The body has been buffered, so its exact length is now known
+			wire, wireCoding := respCoding.encode(resp.Header, respBody)
+			resp.Body = io.NopCloser(bytes.NewReader(wire))
+			resp.ContentLength = int64(len(wire))
+			if bodyAllowed(req.Method, resp.StatusCode) {
+				resp.Header.Set("Content-Length", strconv.Itoa(len(wire)))
+			}
+
+			entry.StatusCode = resp.StatusCode
+			entry.Protocol = resp.Proto
+			entry.ResponseHeaders = resp.Header.Clone()
+			entry.SetResponseBody(respBody)
+			if wireCoding != "" {
+				entry.ResponseBodyInfo.SetRaw(wire, wireCoding)
+			}
+			entry.ContentType = resp.Header.Get("Content-Type")
+			if !forward {
+				entry.Status = "dropped"
+			}
+			saveEntry()
+
+			if !forward {
+				clientConn.Write([]byte("HTTP/1.1 204 No Content\r\n\r\n"))
+				return keepAlive
+			}
+		}
+	}
+
+	if shouldFilter {
+		// The body is streamed, so only header and status rules apply
+		applyResponseRules(req.Method, fullURL, resp, nil)
 	}
-	clientConn.Write([]byte("\r\n"))
 
-	written, _ := io.Copy(clientConn, resp.Body)
+	// The client connection speaks HTTP/1.1 whatever the upstream protocol
+	written, keepAlive, err := writeResponse(clientConn, req, resp, keepAlive)
 	if !shouldFilter {
 		log.Printf("Body transféré: %d bytes", written)
 	}
+	if streamedResp != nil {
+		streamedResp.Close()
+		entry.Timings.Receive = milliseconds(time.Since(receiveStart))
+		if recorder := streamedResp.record(); recorder != nil {
+			entry.SetStreamedResponseBody(recorder)
+		}
+		if err != nil {
+			entry.Error = err.Error()
+		}
+		saveEntry()
+	}
+	if err != nil {
+		return false
+	}
+
+	return keepAlive
+}
+
+// interceptResponse broadcasts the upstream response to the UI and, when
+// response pause is enabled and the request can be intercepted, waits for
+// it to be edited or dropped.
+// It returns the body to forward, and false if the response must not be
+// forwarded to the client. A body edited as raw bytes resets coding.
+func interceptResponse(requestID string, resp *http.Response, body []byte, coding *codedBody, tlsInfo *history.TLSInfo, intercept bool) ([]byte, bool) {
+	cfg := config.GetInstance()
+	paused := cfg.PauseResponses && intercept
+	status := "passthrough"
+	if paused {
+		status = "pending"
+	}
+
+	responseData := websocket.ResponseData{
+		StatusCode:  resp.StatusCode,
+		Headers:     resp.Header,
+		Status:      status,
+		UpstreamTLS: tlsInfo,
+	}
+	responseData.Body, responseData.BodyInfo = uiBody(body, false, 0)
+	coding.describe(&responseData.BodyInfo)
+	broadcastResponse(requestID, responseData)
+
+	if paused {
+		// Mode pause des réponses activé - attendre une modification
+		modification, hasModification := websocket.WaitForResponseModification(requestID, time.Duration(cfg.PauseTimeout))
+
+		if hasModification {
+			switch modification.Action {
+			case "send":
+				if modification.StatusCode != 0 {
+					resp.StatusCode = modification.StatusCode
+					resp.Status = fmt.Sprintf("%d %s", modification.StatusCode, http.StatusText(modification.StatusCode))
+				}
+				if modification.Body != "" {
+					if decoded, err := content.Decode(modification.Body, modification.Encoding); err == nil {
+						body = decoded
+						if modification.SendRaw {
+							*coding = codedBody{}
+						}
+					} else {
+						log.Printf("Corps modifié ignoré: %v", err)
+					}
+				}
+				for k, v := range modification.Headers {
+					resp.Header[k] = v
+				}
+			case "drop":
+				return body, false
+			}
+		}
+	}
+
+	return body, true
+}
+
+// broadcastResponse sends a response to the interface
+func broadcastResponse(requestID string, data websocket.ResponseData) {
+	message := websocket.Message{
+		Type: "response",
+		ID:   requestID,
+		Data: data,
+	}
+
+	jsonData, err := json.Marshal(message)
+	if err != nil {
+		log.Printf("Error marshaling JSON: %v", err)
+		return
+	}
+	websocket.BroadcastChannel <- jsonData
+}
+
+// applyResponseRules applies the response rules to resp and returns the
+// possibly rewritten body. A nil body means the body is streamed.
+func applyResponseRules(method string, fullURL string, resp *http.Response, body []byte) []byte {
+	ruleResponse := rules.Response{StatusCode: resp.StatusCode, Header: resp.Header, Body: body}
+	rules.ApplyResponse(method, fullURL, &ruleResponse)
+
+	if ruleResponse.StatusCode != resp.StatusCode {
+		resp.StatusCode = ruleResponse.StatusCode
+		resp.Status = fmt.Sprintf("%d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+	return ruleResponse.Body
+}
+
+// milliseconds converts a duration to fractional milliseconds for timings
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// hopHeaders are removed when forwarding a message to the other side
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"TE",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// tunnel relays a CONNECT tunnel to the target without interception
+func tunnel(clientConn net.Conn, hostport string) {
+	if _, _, err := net.SplitHostPort(hostport); err != nil {
+		hostport = net.JoinHostPort(hostport, "443")
+	}
+
+	upstreamConn, err := dialUpstream(hostport)
+	if err != nil {
+		log.Printf("Erreur connexion tunnel vers %s: %v", hostport, err)
+		clientConn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n"))
+		return
+	}
+	defer upstreamConn.Close()
+
+	clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	pipe(clientConn, upstreamConn)
+}
+
+// dialUpstream connects to hostport through the upstream proxy routing its
+// host, if any, verifying an HTTPS proxy like any server
+func dialUpstream(hostport string) (net.Conn, error) {
+	host, _, _ := net.SplitHostPort(hostport)
+	proxyURL, err := config.GetInstance().GetUpstream().ProxyFor(host)
+	if err != nil {
+		return nil, err
+	}
+	return upstream.Dial(proxyURL, hostport, 30*time.Second, config.GetInstance().GetUpstreamTLS())
+}
+
+// pipe copies data both ways until one side is done
+func pipe(clientConn net.Conn, upstreamConn net.Conn) {
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(upstreamConn, clientConn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(clientConn, upstreamConn)
+		done <- struct{}{}
+	}()
+	<-done
 }
 
 // handleHTTP handles regular HTTP requests
-func handleHTTP(clientConn net.Conn, req *http.Request) {
-	processRequest(clientConn, req, false)
+func handleHTTP(clientConn net.Conn, req *http.Request) bool {
+	return processRequest(clientConn, req, false)
 }
 
 func Start() {
+	// Custom TLS settings disable HTTP/2 unless explicitly attempted
+	directTransport.ForceAttemptHTTP2 = !config.GetInstance().ForceHTTP1
+	invalidTransport = directTransport.Clone()
+	invalidTransport.TLSClientConfig.VerifyConnection = nil
+
 	go func() {
 		cfg := config.GetInstance()
-		addr := fmt.Sprintf("127.0.0.1:%d", cfg.ProxyPort)
+		addr := net.JoinHostPort(cfg.ProxyAddress, strconv.Itoa(cfg.ProxyPort))
 
 		listener, err := net.Listen("tcp", addr)
 		if err != nil {
@@ -310,4 +889,14 @@ func Start() {
 			go handleConnection(conn)
 		}
 	}()
+
+	if config.GetInstance().SOCKSPort != 0 {
+		startSOCKS()
+	}
+	for _, port := range config.GetInstance().InvisiblePorts {
+		startInvisible(port)
+	}
+	for _, rp := range config.GetInstance().ReverseProxies {
+		startReverse(rp)
+	}
 }
@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httputil"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// writeResponse serializes resp as HTTP/1.1 for the client of req. The body
+// is framed by its length when it is known, chunked otherwise or to carry
+// trailers, and flushed as it arrives so that server-sent events and long
+// polling are not delayed. It returns the number of body bytes written and
+// whether the connection can be reused.
+func writeResponse(w io.Writer, req *http.Request, resp *http.Response, keepAlive bool) (int64, bool, error) {
+	header := responseHeader(resp.Header)
+	http11 := req.ProtoAtLeast(1, 1)
+
+	hasBody := bodyAllowed(req.Method, resp.StatusCode)
+	chunked := false
+	switch {
+	case !hasBody:
+		// HEAD and 304 keep the length of the representation they describe
+		if resp.StatusCode < 200 || resp.StatusCode == http.StatusNoContent {
+			header.Del("Content-Length")
+		}
+	case resp.ContentLength >= 0 && (len(resp.Trailer) == 0 || !http11):
+		header.Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	case http11:
+		chunked = true
+		header.Del("Content-Length")
+		header.Set("Transfer-Encoding", "chunked")
+		if len(resp.Trailer) > 0 {
+			header.Set("Trailer", strings.Join(sortedKeys(resp.Trailer), ", "))
+		}
+	default:
+		// An HTTP/1.0 client can only tell the end of the body by the
+		// connection being closed
+		header.Del("Content-Length")
+		keepAlive = false
+	}
+	if !keepAlive {
+		header.Set("Connection", "close")
+	} else if !http11 {
+		header.Set("Connection", "keep-alive")
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "HTTP/1.1 %d %s\r\n", resp.StatusCode, reasonPhrase(resp))
+	header.Write(bw)
+	bw.WriteString("\r\n")
+	if !hasBody {
+		return 0, keepAlive, bw.Flush()
+	}
+
+	var body io.Writer = bw
+	var chunks io.WriteCloser
+	if chunked {
+		chunks = httputil.NewChunkedWriter(bw)
+		body = chunks
+	}
+	written, err := copyFlush(body, bw, resp.Body)
+	if err != nil {
+		// The client cannot tell that the body is incomplete but by the
+		// connection being closed
+		bw.Flush()
+		return written, false, err
+	}
+	if chunked {
+		// Trailers are only known once the body has been read
+		chunks.Close()
+		resp.Trailer.Write(bw)
+		bw.WriteString("\r\n")
+	}
+	return written, keepAlive, bw.Flush()
+}
+
+// writeInformational sends a 1xx response, which precedes the final one
+func writeInformational(w io.Writer, code int, header http.Header) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "HTTP/1.1 %d %s\r\n", code, http.StatusText(code))
+	responseHeader(header).Write(bw)
+	bw.WriteString("\r\n")
+	return bw.Flush()
+}
+
+// responseHeader copies a response header without the hop-by-hop headers,
+// which only describe the upstream connection, including those named by
+// its Connection header
+func responseHeader(h http.Header) http.Header {
+	header := h.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	for _, value := range h["Connection"] {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+	return header
+}
+
+// bodyAllowed tells whether a response may have a body (RFC 9112, section 6.3)
+func bodyAllowed(method string, status int) bool {
+	switch {
+	case method == http.MethodHead:
+		return false
+	case status >= 100 && status < 200:
+		return false
+	case status == http.StatusNoContent, status == http.StatusNotModified:
+		return false
+	}
+	return true
+}
+
+// isEventStream tells whether a response is a stream of server-sent events
+func isEventStream(h http.Header) bool {
+	mediaType, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	return mediaType == "text/event-stream"
+}
+
+// reasonPhrase returns the reason of the status line. resp.Status also
+// holds the code, e.g. "200 OK".
+func reasonPhrase(resp *http.Response) string {
+	if reason, found := strings.CutPrefix(resp.Status, strconv.Itoa(resp.StatusCode)+" "); found && reason != "" {
+		return reason
+	}
+	return http.StatusText(resp.StatusCode)
+}
+
+// copyFlush copies a body, flushing after every read so that each part
+// reaches the client as soon as the server sends it
+func copyFlush(dst io.Writer, flusher *bufio.Writer, src io.Reader) (int64, error) {
+	var written int64
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, writeErr := dst.Write(buf[:n]); writeErr != nil {
+				return written, writeErr
+			}
+			written += int64(n)
+			if flushErr := flusher.Flush(); flushErr != nil {
+				return written, flushErr
+			}
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+func sortedKeys(h http.Header) []string {
+	keys := make([]string, 0, len(h))
+	for key := range h {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
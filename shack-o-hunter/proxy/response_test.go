@@ -0,0 +1,252 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestBodyAllowed(t *testing.T) {
+	tests := []struct {
+		method string
+		status int
+		want   bool
+	}{
+		{http.MethodGet, http.StatusOK, true},
+		{http.MethodPost, http.StatusCreated, true},
+		{http.MethodHead, http.StatusOK, false},
+		{http.MethodGet, http.StatusContinue, false},
+		{http.MethodGet, http.StatusSwitchingProtocols, false},
+		{http.MethodGet, http.StatusEarlyHints, false},
+		{http.MethodGet, http.StatusNoContent, false},
+		{http.MethodGet, http.StatusNotModified, false},
+		{http.MethodGet, http.StatusNotFound, true},
+	}
+	for _, tt := range tests {
+		if got := bodyAllowed(tt.method, tt.status); got != tt.want {
+			t.Errorf("bodyAllowed(%s, %d) = %v, want %v", tt.method, tt.status, got, tt.want)
+		}
+	}
+}
+
+func TestResponseHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  http.Header
+		removed []string
+		kept    []string
+	}{
+		{
+			name:   "nil",
+			header: nil,
+		},
+		{
+			name: "hop-by-hop",
+			header: http.Header{
+				"Keep-Alive":        {"timeout=5"},
+				"Transfer-Encoding": {"chunked"},
+				"Connection":        {"keep-alive"},
+				"Content-Type":      {"text/plain"},
+			},
+			removed: []string{"Keep-Alive", "Transfer-Encoding", "Connection"},
+			kept:    []string{"Content-Type"},
+		},
+		{
+			name: "named by Connection",
+			header: http.Header{
+				"Connection":  {"X-Internal, , x-trace"},
+				"X-Internal":  {"1"},
+				"X-Trace":     {"abc"},
+				"X-Forwarded": {"kept"},
+			},
+			removed: []string{"X-Internal", "X-Trace"},
+			kept:    []string{"X-Forwarded"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			original := tt.header.Clone()
+			got := responseHeader(tt.header)
+			if got == nil {
+				t.Fatal("responseHeader returned nil")
+			}
+			for _, name := range tt.removed {
+				if _, ok := got[name]; ok {
+					t.Errorf("%s was kept", name)
+				}
+			}
+			for _, name := range tt.kept {
+				if got.Get(name) != tt.header.Get(name) {
+					t.Errorf("%s = %q, want %q", name, got.Get(name), tt.header.Get(name))
+				}
+			}
+			if len(tt.header) != len(original) {
+				t.Errorf("the server's header was modified")
+			}
+		})
+	}
+}
+
+func TestWriteResponse(t *testing.T) {
+	tests := []struct {
+		name          string
+		method        string
+		http10        bool
+		status        int
+		header        http.Header
+		body          string
+		contentLength int64
+		trailer       http.Header
+		keepAlive     bool
+
+		wantLength    string // Content-Length header, "" if absent
+		wantChunked   bool
+		wantBody      string
+		wantKeepAlive bool
+	}{
+		{
+			name:   "known length",
+			status: http.StatusOK, body: "hello", contentLength: 5, keepAlive: true,
+			wantLength: "5", wantBody: "hello", wantKeepAlive: true,
+		},
+		{
+			name:   "unknown length is chunked",
+			status: http.StatusOK, body: "streamed", contentLength: -1, keepAlive: true,
+			wantChunked: true, wantBody: "streamed", wantKeepAlive: true,
+		},
+		{
+			name:   "trailers are chunked",
+			status: http.StatusOK, body: "data", contentLength: 4, trailer: http.Header{"X-Checksum": {"abc"}}, keepAlive: true,
+			wantChunked: true, wantBody: "data", wantKeepAlive: true,
+		},
+		{
+			name:   "server framing is replaced",
+			status: http.StatusOK, header: http.Header{"Transfer-Encoding": {"chunked"}, "Content-Length": {"99"}},
+			body: "abc", contentLength: 3, keepAlive: true,
+			wantLength: "3", wantBody: "abc", wantKeepAlive: true,
+		},
+		{
+			name:   "HEAD keeps the representation length",
+			method: http.MethodHead, status: http.StatusOK, header: http.Header{"Content-Length": {"1234"}},
+			contentLength: 1234, keepAlive: true,
+			wantLength: "1234", wantKeepAlive: true,
+		},
+		{
+			name:   "no content",
+			status: http.StatusNoContent, header: http.Header{"Content-Length": {"0"}}, keepAlive: true,
+			wantKeepAlive: true,
+		},
+		{
+			name:   "not modified keeps the length",
+			status: http.StatusNotModified, header: http.Header{"Content-Length": {"42"}}, keepAlive: true,
+			wantLength: "42", wantKeepAlive: true,
+		},
+		{
+			name:   "HTTP/1.0 with unknown length closes",
+			http10: true, status: http.StatusOK, body: "until close", contentLength: -1, keepAlive: true,
+			wantBody: "until close", wantKeepAlive: false,
+		},
+		{
+			name:   "HTTP/1.0 with known length stays open",
+			http10: true, status: http.StatusOK, body: "ok", contentLength: 2, keepAlive: true,
+			wantLength: "2", wantBody: "ok", wantKeepAlive: true,
+		},
+		{
+			name:   "close requested",
+			status: http.StatusOK, body: "bye", contentLength: 3, keepAlive: false,
+			wantLength: "3", wantBody: "bye", wantKeepAlive: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			req, _ := http.NewRequest(method, "http://example.com/", nil)
+			if tt.http10 {
+				req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/1.0", 1, 0
+			}
+			header := tt.header
+			if header == nil {
+				header = http.Header{}
+			}
+			resp := &http.Response{
+				StatusCode:    tt.status,
+				Header:        header,
+				Body:          io.NopCloser(strings.NewReader(tt.body)),
+				ContentLength: tt.contentLength,
+				Trailer:       tt.trailer,
+			}
+
+			var out bytes.Buffer
+			written, keepAlive, err := writeResponse(&out, req, resp, tt.keepAlive)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if keepAlive != tt.wantKeepAlive {
+				t.Errorf("keepAlive = %v, want %v", keepAlive, tt.wantKeepAlive)
+			}
+			if written != int64(len(tt.wantBody)) {
+				t.Errorf("written = %d, want %d", written, len(tt.wantBody))
+			}
+
+			raw := out.String()
+			head, _, _ := strings.Cut(raw, "\r\n\r\n")
+			if !strings.HasPrefix(head, "HTTP/1.1 ") {
+				t.Errorf("status line %q", strings.SplitN(head, "\r\n", 2)[0])
+			}
+			parsed, err := http.ReadResponse(bufio.NewReader(strings.NewReader(raw)), req)
+			if err != nil {
+				t.Fatalf("unparsable response %q: %v", raw, err)
+			}
+			body, err := io.ReadAll(parsed.Body)
+			if err != nil {
+				t.Fatalf("unreadable body of %q: %v", raw, err)
+			}
+
+			if got := headerValue(head, "Content-Length"); got != tt.wantLength {
+				t.Errorf("Content-Length = %q, want %q in %q", got, tt.wantLength, head)
+			}
+			if chunked := headerValue(head, "Transfer-Encoding") == "chunked"; chunked != tt.wantChunked {
+				t.Errorf("chunked = %v, want %v in %q", chunked, tt.wantChunked, head)
+			}
+			if string(body) != tt.wantBody {
+				t.Errorf("body = %q, want %q", body, tt.wantBody)
+			}
+			for name, values := range tt.trailer {
+				if parsed.Trailer.Get(name) != values[0] {
+					t.Errorf("trailer %s = %q, want %q", name, parsed.Trailer.Get(name), values[0])
+				}
+			}
+			if parsed.Close == tt.wantKeepAlive {
+				t.Errorf("client would see Close = %v", parsed.Close)
+			}
+		})
+	}
+}
+
+func TestWriteInformational(t *testing.T) {
+	var out bytes.Buffer
+	header := http.Header{"Link": {"</style.css>; rel=preload"}, "Connection": {"keep-alive"}}
+	if err := writeInformational(&out, http.StatusEarlyHints, header); err != nil {
+		t.Fatal(err)
+	}
+	want := "HTTP/1.1 103 Early Hints\r\nLink: </style.css>; rel=preload\r\n\r\n"
+	if out.String() != want {
+		t.Errorf("got %q, want %q", out.String(), want)
+	}
+}
+
+// headerValue returns a header field of a raw response head, as written
+func headerValue(head string, name string) string {
+	for _, line := range strings.Split(head, "\r\n")[1:] {
+		if key, value, found := strings.Cut(line, ":"); found && strings.EqualFold(key, name) {
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
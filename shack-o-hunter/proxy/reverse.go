@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"proxy-interceptor/cert"
+	"proxy-interceptor/config"
+	"strconv"
+	"strings"
+)
+
+// clientHostKey is the request context key holding the Host header sent
+// to a reverse proxy backend when it is not rewritten
+type clientHostKey struct{}
+
+// startReverse listens on a port and forwards every request to a single
+// backend through the interception pipeline
+func startReverse(rp config.ReverseProxy) {
+	go func() {
+		cfg := config.GetInstance()
+		addr := net.JoinHostPort(cfg.ProxyAddress, strconv.Itoa(rp.Port))
+		backend, _ := url.Parse(rp.Target) // Validated with the configuration
+
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			log.Fatalf("Erreur lors du démarrage du reverse proxy: %v", err)
+		}
+		if rp.TLS {
+			listener = tls.NewListener(listener, reverseTLSConfig(rp))
+		}
+		defer listener.Close()
+
+		log.Printf("Reverse proxy %s vers %s", addr, rp.Target)
+
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				log.Printf("Erreur lors de l'acceptation de la connexion: %v", err)
+				continue
+			}
+
+			go handleReverse(conn, rp, backend)
+		}
+	}()
+}
+
+// reverseTLSConfig issues certificates for the SNI name, or the configured
+// name for clients without SNI
+func reverseTLSConfig(rp config.ReverseProxy) *tls.Config {
+	defaultName := rp.TLSHost
+	if defaultName == "" {
+		defaultName = "localhost"
+	}
+	return &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			name := hello.ServerName
+			if name == "" {
+				name = defaultName
+			}
+			return cert.GenerateCertForHost(name)
+		},
+		MinVersion: tls.VersionTLS12,
+	}
+}
+
+// handleReverse serves every request of a connection to the backend
+func handleReverse(clientConn net.Conn, rp config.ReverseProxy, backend *url.URL) {
+	defer clientConn.Close()
+
+	reader := bufio.NewReader(clientConn)
+	for {
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			if !isClosedConnError(err) {
+				log.Printf("Erreur lors de la lecture de la requête: %v", err)
+			}
+			return
+		}
+
+		clientHost := req.Host
+		req.URL.Scheme = backend.Scheme
+		req.URL.Host = backend.Host
+		req.URL.Path = joinPath(backend.Path, req.URL.Path)
+		req.URL.RawPath = ""
+		req.Host = backend.Host
+		if !rp.RewriteHost && clientHost != "" {
+			req = req.WithContext(context.WithValue(req.Context(), clientHostKey{}, clientHost))
+		}
+
+		if !processRequest(clientConn, req, false) {
+			return
+		}
+	}
+}
+
+// joinPath prefixes the request path with the backend's base path
+func joinPath(base string, path string) string {
+	if base == "" || base == "/" {
+		return path
+	}
+	return strings.TrimSuffix(base, "/") + "/" + strings.TrimPrefix(path, "/")
+}
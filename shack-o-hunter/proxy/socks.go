@@ -0,0 +1,323 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"proxy-interceptor/config"
+	"strconv"
+	"time"
+)
+
+// sniffTimeout is how long the client has to speak first before the
+// connection is relayed as is, e.g. for SMTP or SSH where the server speaks first
+const sniffTimeout = 2 * time.Second
+
+// maxRecordSize fits a whole TLS record so that the ClientHello can be peeked
+const maxRecordSize = 5 + 16384
+
+// httpMethods are the request line prefixes recognised as plain HTTP
+var httpMethods = [][]byte{
+	[]byte("GET "), []byte("POST "), []byte("PUT "), []byte("HEAD "), []byte("DELETE "),
+	[]byte("OPTIONS "), []byte("PATCH "), []byte("TRACE "), []byte("CONNECT "),
+}
+
+// SOCKS reply codes, SOCKS5 then SOCKS4
+const (
+	socks5Succeeded          = 0x00
+	socks5GeneralFailure     = 0x01
+	socks5CommandUnsupported = 0x07
+	socks5AddressUnsupported = 0x08
+	socks4Granted            = 0x5a
+	socks4Rejected           = 0x5b
+)
+
+// startSOCKS listens for SOCKS5 and SOCKS4a clients
+func startSOCKS() {
+	go func() {
+		cfg := config.GetInstance()
+		addr := net.JoinHostPort(cfg.ProxyAddress, strconv.Itoa(cfg.SOCKSPort))
+
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			log.Fatalf("Erreur lors du démarrage du proxy SOCKS: %v", err)
+		}
+		defer listener.Close()
+
+		log.Printf("Proxy SOCKS5/SOCKS4a en attente de connexions sur %s...", addr)
+
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				log.Printf("Erreur lors de l'acceptation de la connexion SOCKS: %v", err)
+				continue
+			}
+
+			go handleSOCKS(conn)
+		}
+	}()
+}
+
+// handleSOCKS performs the SOCKS handshake, then serves the connection to the
+// requested destination
+func handleSOCKS(clientConn net.Conn) {
+	defer clientConn.Close()
+
+	clientConn.SetDeadline(time.Now().Add(30 * time.Second))
+	reader := bufio.NewReaderSize(clientConn, maxRecordSize)
+
+	version, err := reader.ReadByte()
+	if err != nil {
+		return
+	}
+
+	var hostport string
+	switch version {
+	case 5:
+		hostport, err = socks5Handshake(clientConn, reader)
+	case 4:
+		hostport, err = socks4Handshake(clientConn, reader)
+	default:
+		err = fmt.Errorf("unsupported SOCKS version %d", version)
+	}
+	if err != nil {
+		log.Printf("Erreur SOCKS: %v", err)
+		return
+	}
+	clientConn.SetDeadline(time.Time{})
+
+	handleStream(&peekedConn{Conn: clientConn, reader: reader}, reader, hostport)
+}
+
+// socks5Handshake negotiates the authentication method and reads a CONNECT
+// command. Only "no authentication" is offered.
+func socks5Handshake(clientConn net.Conn, reader *bufio.Reader) (string, error) {
+	count, err := reader.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	methods := make([]byte, count)
+	if _, err := io.ReadFull(reader, methods); err != nil {
+		return "", err
+	}
+	if bytes.IndexByte(methods, 0x00) < 0 {
+		clientConn.Write([]byte{5, 0xff})
+		return "", errors.New("SOCKS5 client requires authentication")
+	}
+	clientConn.Write([]byte{5, 0x00})
+
+	header := make([]byte, 4) // version, command, reserved, address type
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return "", err
+	}
+	if header[1] != 1 {
+		socks5Reply(clientConn, socks5CommandUnsupported)
+		return "", fmt.Errorf("unsupported SOCKS5 command %d", header[1])
+	}
+
+	var host string
+	switch header[3] {
+	case 1, 4: // IPv4, IPv6
+		ip := make(net.IP, 4)
+		if header[3] == 4 {
+			ip = make(net.IP, 16)
+		}
+		if _, err := io.ReadFull(reader, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case 3: // Domain name
+		length, err := reader.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		name := make([]byte, length)
+		if _, err := io.ReadFull(reader, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		socks5Reply(clientConn, socks5AddressUnsupported)
+		return "", fmt.Errorf("unsupported SOCKS5 address type %d", header[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(reader, port); err != nil {
+		return "", err
+	}
+
+	// The destination is only dialled once the client's protocol is known
+	if err := socks5Reply(clientConn, socks5Succeeded); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+func socks5Reply(clientConn net.Conn, code byte) error {
+	_, err := clientConn.Write([]byte{5, code, 0, 1, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// socks4Handshake reads a SOCKS4 CONNECT command. An address of 0.0.0.x
+// means SOCKS4a, with the host name following the user ID.
+func socks4Handshake(clientConn net.Conn, reader *bufio.Reader) (string, error) {
+	header := make([]byte, 7) // command, port, IPv4 address
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return "", err
+	}
+	if _, err := reader.ReadBytes(0); err != nil { // User ID
+		return "", err
+	}
+	if header[0] != 1 {
+		clientConn.Write([]byte{0, socks4Rejected, 0, 0, 0, 0, 0, 0})
+		return "", fmt.Errorf("unsupported SOCKS4 command %d", header[0])
+	}
+
+	port := binary.BigEndian.Uint16(header[1:3])
+	ip := net.IP(header[3:7])
+	host := ip.String()
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		name, err := reader.ReadBytes(0)
+		if err != nil {
+			return "", err
+		}
+		host = string(name[:len(name)-1])
+	}
+
+	if _, err := clientConn.Write([]byte{0, socks4Granted, 0, 0, 0, 0, 0, 0}); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+}
+
+// handleStream serves a connection by sniffing what the client sends first:
+// TLS is intercepted, plain HTTP goes through the usual request pipeline and
+// anything else is relayed untouched. An empty hostport means the destination
+// is not known and is taken from the SNI or the Host header instead.
+// reader must be the one clientConn reads from.
+func handleStream(clientConn net.Conn, reader *bufio.Reader, hostport string) {
+	clientConn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	_, err := reader.Peek(1)
+	clientConn.SetReadDeadline(time.Time{})
+	if err != nil && !isTimeout(err) {
+		return
+	}
+
+	switch {
+	case err == nil && isTLSHandshake(reader):
+		// Clients that resolved the name themselves only give an IP,
+		// the SNI is the name they expect a certificate for
+		host, port, _ := net.SplitHostPort(hostport)
+		if serverName := clientHelloServerName(reader); serverName != "" && (hostport == "" || net.ParseIP(host) != nil) {
+			if port == "" {
+				port = "443"
+			}
+			hostport = net.JoinHostPort(serverName, port)
+		}
+		if hostport == "" {
+			log.Printf("Connexion TLS sans SNI de %s ignorée: destination inconnue", clientConn.RemoteAddr())
+			return
+		}
+
+		decision := checkScope(newTarget("https", hostport, ""))
+		if !decision.MITM {
+			relay(clientConn, hostport)
+			return
+		}
+		interceptTLS(clientConn, hostport, decision.Log)
+	case err == nil && isHTTPRequest(reader):
+		serveHTTP(clientConn, reader, hostport)
+	case hostport == "":
+		log.Printf("Protocole inconnu de %s ignoré: destination inconnue", clientConn.RemoteAddr())
+	default:
+		relay(clientConn, hostport)
+	}
+}
+
+// relay copies a connection to its destination without interception
+func relay(clientConn net.Conn, hostport string) {
+	upstreamConn, err := dialUpstream(hostport)
+	if err != nil {
+		log.Printf("Erreur connexion relais vers %s: %v", hostport, err)
+		return
+	}
+	defer upstreamConn.Close()
+
+	pipe(clientConn, upstreamConn)
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// isTLSHandshake checks for a TLS handshake record header
+func isTLSHandshake(reader *bufio.Reader) bool {
+	header, err := reader.Peek(3)
+	return err == nil && header[0] == 0x16 && header[1] == 0x03
+}
+
+// isHTTPRequest checks the buffered bytes for an HTTP request line
+func isHTTPRequest(reader *bufio.Reader) bool {
+	buffered, _ := reader.Peek(reader.Buffered())
+	for _, method := range httpMethods {
+		if bytes.HasPrefix(buffered, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientHelloServerName peeks at the TLS ClientHello and returns its SNI
+// name, or an empty string if there is none. Nothing is consumed.
+func clientHelloServerName(reader *bufio.Reader) string {
+	header, err := reader.Peek(5)
+	if err != nil {
+		return ""
+	}
+	record, err := reader.Peek(5 + int(binary.BigEndian.Uint16(header[3:5])))
+	if err != nil {
+		return ""
+	}
+
+	// Let crypto/tls parse the ClientHello and abort the handshake right after
+	var serverName string
+	tls.Server(&helloConn{reader: bytes.NewReader(record)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errors.New("client hello read")
+		},
+	}).Handshake()
+	return serverName
+}
+
+// peekedConn reads through the buffered reader used for sniffing so that
+// the peeked bytes are not lost
+type peekedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// helloConn is a read-only connection over a recorded ClientHello
+type helloConn struct {
+	reader io.Reader
+}
+
+func (c *helloConn) Read(p []byte) (int, error)         { return c.reader.Read(p) }
+func (c *helloConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c *helloConn) Close() error                       { return nil }
+func (c *helloConn) LocalAddr() net.Addr                { return nil }
+func (c *helloConn) RemoteAddr() net.Addr               { return nil }
+func (c *helloConn) SetDeadline(t time.Time) error      { return nil }
+func (c *helloConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *helloConn) SetWriteDeadline(t time.Time) error { return nil }
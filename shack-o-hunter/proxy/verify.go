@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"proxy-interceptor/config"
+	"proxy-interceptor/history"
+	"sync"
+	"time"
+)
+
+// acceptInvalidKey marks the requests of a client that was shown an invalid
+// certificate and went on anyway: their server is not verified
+type acceptInvalidKey struct{}
+
+// acceptInvalid marks req as accepting an invalid server certificate
+func acceptInvalid(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), acceptInvalidKey{}, true))
+}
+
+func acceptsInvalid(req *http.Request) bool {
+	return req.Context().Value(acceptInvalidKey{}) != nil
+}
+
+// invalidTransport sends the requests accepting an invalid certificate. Its
+// connections must not be shared with directTransport's.
+var invalidTransport *http.Transport
+
+// upstreamTransport sends requests through directTransport, or through
+// invalidTransport when the client accepted an invalid certificate, with
+// the client certificate registered for the server if any
+type upstreamTransport struct{}
+
+func (upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req, clientCert := withClientCert(req)
+	return transportFor(clientCert, acceptsInvalid(req), req.URL.Hostname()).RoundTrip(req)
+}
+
+// verifyError is a server certificate refused by the policy
+type verifyError struct {
+	host string
+	info *history.TLSInfo
+	err  error
+}
+
+func (e *verifyError) Error() string {
+	if e.host == "" {
+		return fmt.Sprintf("server certificate not trusted: %v", e.err)
+	}
+	return fmt.Sprintf("certificate of %s not trusted: %v", e.host, e.err)
+}
+
+// verifyUpstream applies the certificate policy to a server of host, during
+// the handshake so that no request reaches a refused server
+func verifyUpstream(state tls.ConnectionState, host string) error {
+	policy := config.GetInstance().GetUpstreamTLS()
+	if !policy.Verify || policy.Ignores(host) {
+		return nil
+	}
+	if err := policy.Check(state.PeerCertificates, host); err != nil {
+		return &verifyError{host: host, info: describeTLS(&state, host), err: err}
+	}
+	return nil
+}
+
+// verdictTTL is how long the verification of a server, done before
+// answering the client's handshake, is reused
+const verdictTTL = 5 * time.Minute
+
+type verdict struct {
+	reason  string
+	expires time.Time
+}
+
+var verdicts = struct {
+	mu      sync.Mutex
+	entries map[string]verdict
+}{entries: make(map[string]verdict)}
+
+// invalidUpstream dials the server before the client's handshake completes
+// and returns why its certificate for name is refused, when the policy
+// reflects invalid certificates to the client. It is empty otherwise, or if
+// the server cannot be reached.
+func invalidUpstream(name string, hostport string) string {
+	policy := config.GetInstance().GetUpstreamTLS()
+	if !policy.Verify || !policy.ReflectInvalid || policy.Ignores(name) {
+		return ""
+	}
+
+	key := hostport + " " + name
+	verdicts.mu.Lock()
+	v, ok := verdicts.entries[key]
+	verdicts.mu.Unlock()
+	if ok && time.Now().Before(v.expires) {
+		return v.reason
+	}
+
+	chain, err := upstreamChain(hostport, name)
+	if err != nil {
+		return ""
+	}
+	v = verdict{expires: time.Now().Add(verdictTTL)}
+	if err := policy.Check(chain, name); err != nil {
+		v.reason = err.Error()
+	}
+
+	verdicts.mu.Lock()
+	for k, old := range verdicts.entries {
+		if time.Now().After(old.expires) {
+			delete(verdicts.entries, k)
+		}
+	}
+	verdicts.entries[key] = v
+	verdicts.mu.Unlock()
+	return v.reason
+}
+
+// tlsVersionName names a TLS version like tls.VersionName, which needs Go 1.21
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+	return fmt.Sprintf("0x%04X", version)
+}
+
+// describeTLS records the server's chain and whether the policy's roots
+// trust it for host
+func describeTLS(state *tls.ConnectionState, host string) *history.TLSInfo {
+	info := &history.TLSInfo{
+		Version:     tlsVersionName(state.Version),
+		CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+		ServerName:  state.ServerName,
+		Chain:       []history.CertInfo{},
+	}
+	for _, c := range state.PeerCertificates {
+		sum := sha256.Sum256(c.Raw)
+		info.Chain = append(info.Chain, history.CertInfo{
+			Subject:   c.Subject.String(),
+			Issuer:    c.Issuer.String(),
+			SHA256:    hex.EncodeToString(sum[:]),
+			NotBefore: c.NotBefore,
+			NotAfter:  c.NotAfter,
+			DNSNames:  c.DNSNames,
+		})
+	}
+
+	policy := config.GetInstance().GetUpstreamTLS()
+	if err := policy.Check(state.PeerCertificates, host); err != nil {
+		info.VerifyError = err.Error()
+		info.Ignored = policy.Ignores(host)
+		return info
+	}
+	info.Verified = true
+	return info
+}
@@ -0,0 +1,324 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"proxy-interceptor/config"
+	"proxy-interceptor/history"
+	"proxy-interceptor/websocket"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// maxFramePayload bounds the memory used by a single relayed frame
+const maxFramePayload = 64 << 20
+
+// WebSocket opcodes, RFC 6455 section 5.2
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+)
+
+// wsFrame is a single WebSocket frame with an unmasked payload
+type wsFrame struct {
+	fin     bool
+	rsv     byte // RSV1-3 bits, already shifted in place
+	opcode  byte
+	payload []byte
+}
+
+// isWebSocketUpgrade checks for a WebSocket opening handshake
+func isWebSocketUpgrade(req *http.Request) bool {
+	if !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, value := range req.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wsSession relays the frames of an upgraded connection. Frames are only
+// recorded and broadcast when entry is set, i.e. when the upgrade is logged.
+type wsSession struct {
+	entry     *history.Entry
+	intercept bool
+}
+
+// relayWebSocket answers the client with the upgrade response, then relays
+// frames both ways until either side closes the connection
+func relayWebSocket(clientConn net.Conn, resp *http.Response, entry *history.Entry, intercept bool) {
+	upstreamConn, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		log.Printf("Erreur WebSocket: connexion amont non bidirectionnelle")
+		return
+	}
+	defer upstreamConn.Close()
+
+	if entry != nil {
+		entry.StatusCode = resp.StatusCode
+		entry.Protocol = resp.Proto
+		entry.ResponseHeaders = resp.Header.Clone()
+		history.Save(entry)
+		broadcast(websocket.Message{Type: "response", ID: entry.ID, Data: websocket.ResponseData{
+			StatusCode: resp.StatusCode,
+			Headers:    resp.Header,
+			Status:     "passthrough",
+		}})
+	}
+
+	// The upgrade headers are kept, they describe the new protocol
+	fmt.Fprintf(clientConn, "HTTP/1.1 %d %s\r\n", resp.StatusCode, reasonPhrase(resp))
+	if err := resp.Header.Write(clientConn); err != nil {
+		return
+	}
+	if _, err := io.WriteString(clientConn, "\r\n"); err != nil {
+		return
+	}
+
+	session := &wsSession{entry: entry, intercept: intercept}
+	var closeOnce sync.Once
+	closeBoth := func() {
+		closeOnce.Do(func() {
+			clientConn.Close()
+			upstreamConn.Close()
+		})
+	}
+
+	done := make(chan struct{})
+	go func() {
+		// Frames sent by a client must be masked
+		session.relay(clientConn, upstreamConn, "client", true)
+		closeBoth()
+		close(done)
+	}()
+	session.relay(upstreamConn, clientConn, "server", false)
+	closeBoth()
+	<-done
+}
+
+// relay forwards frames from src to dst until an error occurs
+func (s *wsSession) relay(src io.Reader, dst io.Writer, direction string, mask bool) {
+	var messageOpcode byte // Opcode of the fragmented message in progress
+	for {
+		frame, err := readFrame(src)
+		if err != nil {
+			if err != io.EOF && !isClosedConnError(err) {
+				log.Printf("Erreur lecture frame WebSocket (%s): %v", direction, err)
+			}
+			return
+		}
+
+		// Continuation frames carry the type of the first fragment
+		dataType := frame.opcode
+		if frame.opcode == opContinuation {
+			dataType = messageOpcode
+		} else if frame.opcode < opClose {
+			messageOpcode = frame.opcode
+		}
+
+		if s.entry != nil && !s.process(frame, direction, dataType) {
+			continue
+		}
+
+		if err := writeFrame(dst, frame, mask); err != nil {
+			return
+		}
+	}
+}
+
+// process records and broadcasts a frame, pausing data frames when enabled.
+// It returns false if the frame must be dropped.
+func (s *wsSession) process(frame *wsFrame, direction string, dataType byte) bool {
+	cfg := config.GetInstance()
+	paused := cfg.PauseWebSocket && s.intercept && frame.opcode < opClose
+
+	record := history.Frame{
+		ID:        uuid.New().String(),
+		Time:      time.Now(),
+		Direction: direction,
+		Opcode:    int(frame.opcode),
+		Fin:       frame.fin,
+		Status:    "passthrough",
+	}
+	record.Payload, record.Encoding = encodePayload(frame.payload, dataType)
+
+	data := websocket.FrameData{
+		EntryID:   s.entry.ID,
+		Direction: direction,
+		Opcode:    record.Opcode,
+		Fin:       record.Fin,
+		Payload:   record.Payload,
+		Encoding:  record.Encoding,
+		Status:    "passthrough",
+	}
+	if paused {
+		data.Status = "pending"
+	}
+	broadcast(websocket.Message{Type: "ws_frame", ID: record.ID, Data: data})
+
+	forward := true
+	if paused {
+		modification, hasModification := websocket.WaitForFrameModification(record.ID, time.Duration(cfg.PauseTimeout))
+		record.Status = "sent"
+		if hasModification {
+			switch modification.Action {
+			case "send":
+				if modification.Payload != "" || modification.Encoding != "" {
+					payload, err := decodePayload(modification.Payload, modification.Encoding)
+					if err != nil {
+						log.Printf("Frame %s: payload modifié invalide: %v", record.ID, err)
+						break
+					}
+					frame.payload = payload
+					record.Payload, record.Encoding = encodePayload(payload, dataType)
+				}
+			case "drop":
+				record.Status = "dropped"
+				forward = false
+			}
+		}
+	}
+
+	history.AddFrame(s.entry.ID, record)
+	return forward
+}
+
+// encodePayload returns text payloads as is and binary ones in base64
+func encodePayload(payload []byte, dataType byte) (string, string) {
+	if dataType == opBinary {
+		return base64.StdEncoding.EncodeToString(payload), "base64"
+	}
+	return string(payload), ""
+}
+
+func decodePayload(payload string, encoding string) ([]byte, error) {
+	switch encoding {
+	case "":
+		return []byte(payload), nil
+	case "base64":
+		return base64.StdEncoding.DecodeString(payload)
+	default:
+		return nil, fmt.Errorf("unknown encoding %q", encoding)
+	}
+}
+
+func broadcast(message websocket.Message) {
+	jsonData, err := json.Marshal(message)
+	if err != nil {
+		log.Printf("Error marshaling JSON: %v", err)
+		return
+	}
+	websocket.BroadcastChannel <- jsonData
+}
+
+// readFrame reads a frame and unmasks its payload
+func readFrame(r io.Reader) (*wsFrame, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+
+	frame := &wsFrame{
+		fin:    header[0]&0x80 != 0,
+		rsv:    header[0] & 0x70,
+		opcode: header[0] & 0x0f,
+	}
+	masked := header[1]&0x80 != 0
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var extended [2]byte
+		if _, err := io.ReadFull(r, extended[:]); err != nil {
+			return nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err := io.ReadFull(r, extended[:]); err != nil {
+			return nil, err
+		}
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+	if length > maxFramePayload {
+		return nil, fmt.Errorf("frame too large: %d bytes", length)
+	}
+
+	var key [4]byte
+	if masked {
+		if _, err := io.ReadFull(r, key[:]); err != nil {
+			return nil, err
+		}
+	}
+
+	frame.payload = make([]byte, length)
+	if _, err := io.ReadFull(r, frame.payload); err != nil {
+		return nil, err
+	}
+	if masked {
+		maskBytes(frame.payload, key)
+	}
+	return frame, nil
+}
+
+// writeFrame writes a frame, masking it with a new key if requested
+func writeFrame(w io.Writer, frame *wsFrame, mask bool) error {
+	header := make([]byte, 2, 14)
+	header[0] = frame.rsv | frame.opcode
+	if frame.fin {
+		header[0] |= 0x80
+	}
+
+	length := len(frame.payload)
+	switch {
+	case length < 126:
+		header[1] = byte(length)
+	case length <= 0xffff:
+		header[1] = 126
+		header = binary.BigEndian.AppendUint16(header, uint16(length))
+	default:
+		header[1] = 127
+		header = binary.BigEndian.AppendUint64(header, uint64(length))
+	}
+
+	payload := frame.payload
+	if mask {
+		header[1] |= 0x80
+		var key [4]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return err
+		}
+		header = append(header, key[:]...)
+		payload = append([]byte(nil), frame.payload...)
+		maskBytes(payload, key)
+	}
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+func maskBytes(data []byte, key [4]byte) {
+	for i := range data {
+		data[i] ^= key[i%4]
+	}
+}
@@ -0,0 +1,253 @@
+package repeater
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"proxy-interceptor/content"
+	"proxy-interceptor/history"
+	"proxy-interceptor/proxy"
+	"proxy-interceptor/websocket"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// maxAttemptsPerTab bounds the memory used by a single repeater tab
+const maxAttemptsPerTab = 100
+
+// SentRequest is the request as it was actually sent
+type SentRequest struct {
+	Method   string              `json:"method"`
+	URL      string              `json:"url"`
+	Headers  map[string][]string `json:"headers"`
+	Body     string              `json:"body"`
+	Encoding string              `json:"encoding,omitempty"` // "base64" or "hex" for a binary body
+}
+
+// Attempt is the result of sending a request from the repeater
+type Attempt struct {
+	ID               string              `json:"id"`
+	Tab              string              `json:"tab"`
+	SentAt           time.Time           `json:"sent_at"`
+	Request          SentRequest         `json:"request"`
+	StatusCode       int                 `json:"status_code,omitempty"`
+	Status           string              `json:"status,omitempty"`
+	ResponseHeaders  map[string][]string `json:"response_headers,omitempty"`
+	ResponseBody     string              `json:"response_body,omitempty"`
+	ResponseEncoding string              `json:"response_encoding,omitempty"`
+	ContentEncoding  string              `json:"content_encoding,omitempty"` // The response body was decoded from, e.g. "gzip"
+	Duration         float64             `json:"duration"`                   // Milliseconds until the full body was read
+	Error            string              `json:"error,omitempty"`
+}
+
+// requestTimeout bounds a repeated request, its response body included
+const requestTimeout = 30 * time.Second
+
+// Client sends repeated requests. It defaults to the proxy's upstream client
+// and can be replaced to route repeater traffic differently.
+var Client = proxy.DirectClient()
+
+var (
+	tabs   = make(map[string][]Attempt)
+	tabsMu sync.RWMutex
+)
+
+// Start handles repeater commands coming from the WebSocket
+func Start() {
+	go func() {
+		for request := range websocket.RepeatChannel {
+			switch request.Action {
+			case "send":
+				go func(r websocket.RepeatRequest) {
+					attempt := Send(r)
+					broadcast("repeat_result", r.ID, attempt)
+				}(request)
+			case "history":
+				broadcast("repeat_history", request.Tab, History(request.Tab))
+			case "clear":
+				Clear(request.Tab)
+			default:
+				log.Printf("Unknown repeater action: %s", request.Action)
+			}
+		}
+	}()
+}
+
+// Send builds the request described by r, optionally starting from a stored
+// history entry, sends it and records the attempt in the tab's history
+func Send(r websocket.RepeatRequest) Attempt {
+	attempt := Attempt{
+		ID:     uuid.New().String(),
+		Tab:    r.Tab,
+		SentAt: time.Now(),
+	}
+
+	sent, err := buildRequest(r)
+	attempt.Request = sent
+	if err != nil {
+		attempt.Error = err.Error()
+		record(attempt)
+		return attempt
+	}
+
+	body, err := content.Decode(sent.Body, sent.Encoding)
+	if err != nil {
+		attempt.Error = err.Error()
+		record(attempt)
+		return attempt
+	}
+
+	// The proxy's client does not bound reading the body, which a repeated
+	// request must not wait on forever
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, sent.Method, sent.URL, bytes.NewReader(body))
+	if err != nil {
+		attempt.Error = err.Error()
+		record(attempt)
+		return attempt
+	}
+	req.Header = http.Header(sent.Headers).Clone()
+	if host := req.Header.Get("Host"); host != "" {
+		req.Host = host
+	}
+
+	client := Client
+	if r.FollowRedirects {
+		followClient := *Client
+		followClient.CheckRedirect = nil
+		client = &followClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		attempt.Duration = milliseconds(time.Since(attempt.SentAt))
+		attempt.Error = err.Error()
+		record(attempt)
+		return attempt
+	}
+	defer resp.Body.Close()
+
+	body, err = io.ReadAll(resp.Body)
+	attempt.Duration = milliseconds(time.Since(attempt.SentAt))
+	if err != nil {
+		attempt.Error = err.Error()
+	}
+
+	attempt.StatusCode = resp.StatusCode
+	attempt.Status = resp.Status
+	attempt.ResponseHeaders = resp.Header
+	if coding := resp.Header.Get("Content-Encoding"); coding != "" && len(body) > 0 {
+		if plain, err := content.Decompress(body, coding); err == nil {
+			body = plain
+			attempt.ContentEncoding = coding
+		}
+	}
+	attempt.ResponseBody, attempt.ResponseEncoding = content.Encode(body)
+
+	log.Printf("Repeater: %s %s -> %d (%.0f ms)", sent.Method, sent.URL, resp.StatusCode, attempt.Duration)
+
+	record(attempt)
+	return attempt
+}
+
+// buildRequest merges the stored history entry, if any, with the fields
+// provided by the UI. Non-empty fields override the stored ones.
+func buildRequest(r websocket.RepeatRequest) (SentRequest, error) {
+	sent := SentRequest{Method: http.MethodGet, Headers: map[string][]string{}}
+
+	if r.EntryID != "" {
+		entry, exists := history.Get(r.EntryID)
+		if !exists {
+			return sent, fmt.Errorf("history entry %s not found", r.EntryID)
+		}
+		sent.Method = entry.Method
+		sent.URL = entry.URL
+		sent.Headers = http.Header(entry.RequestHeaders).Clone()
+		// Sent as it was on the wire, compressed if it was
+		body, err := entry.RawRequestBodyBytes()
+		if err != nil {
+			return sent, fmt.Errorf("history entry %s: %v", r.EntryID, err)
+		}
+		sent.Body, sent.Encoding = content.Encode(body)
+	}
+
+	if r.Method != "" {
+		sent.Method = r.Method
+	}
+	if r.URL != "" {
+		sent.URL = r.URL
+	}
+	if r.Body != "" {
+		sent.Body, sent.Encoding = r.Body, r.Encoding
+	}
+	if r.Headers != nil {
+		sent.Headers = r.Headers
+	}
+
+	// A body typed in the UI is plaintext, compressed as its headers say
+	coding := http.Header(sent.Headers).Get("Content-Encoding")
+	if r.Body != "" && !r.SendRaw && coding != "" {
+		plain, err := content.Decode(sent.Body, sent.Encoding)
+		if err != nil {
+			return sent, err
+		}
+		compressed, err := content.Compress(plain, coding)
+		if err != nil {
+			return sent, err
+		}
+		sent.Body, sent.Encoding = content.Encode(compressed)
+	}
+
+	if sent.URL == "" {
+		return sent, fmt.Errorf("missing url")
+	}
+	return sent, nil
+}
+
+// History returns the attempts of a tab, oldest first
+func History(tab string) []Attempt {
+	tabsMu.RLock()
+	defer tabsMu.RUnlock()
+
+	attempts := make([]Attempt, len(tabs[tab]))
+	copy(attempts, tabs[tab])
+	return attempts
+}
+
+// Clear forgets every attempt of a tab
+func Clear(tab string) {
+	tabsMu.Lock()
+	defer tabsMu.Unlock()
+	delete(tabs, tab)
+}
+
+func record(attempt Attempt) {
+	tabsMu.Lock()
+	defer tabsMu.Unlock()
+
+	attempts := append(tabs[attempt.Tab], attempt)
+	if len(attempts) > maxAttemptsPerTab {
+		attempts = attempts[len(attempts)-maxAttemptsPerTab:]
+	}
+	tabs[attempt.Tab] = attempts
+}
+
+func broadcast(messageType string, id string, data any) {
+	jsonData, err := json.Marshal(websocket.Message{Type: messageType, ID: id, Data: data})
+	if err != nil {
+		log.Printf("Error marshaling JSON: %v", err)
+		return
+	}
+	websocket.BroadcastChannel <- jsonData
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
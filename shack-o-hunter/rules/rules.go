@@ -0,0 +1,357 @@
+package rules
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"proxy-interceptor/config"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// Rule is a declarative match-and-replace rule. Every non-empty match
+// condition must hold for the action to be applied.
+type Rule struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+	Stage   string `json:"stage"` // "request", "response"
+
+	// Match conditions, evaluated against the request for both stages
+	// except Header and Body which use the message of the rule's stage
+	Scheme string `json:"scheme,omitempty"` // Exact, e.g. "https"
+	Host   string `json:"host,omitempty"`   // Regular expression
+	Path   string `json:"path,omitempty"`   // Regular expression
+	Method string `json:"method,omitempty"` // Exact, case-insensitive
+	Header string `json:"header,omitempty"` // Regular expression matched against "Name: value" lines
+	Body   string `json:"body,omitempty"`   // Regular expression
+
+	// Action
+	Action     string `json:"action"`                // "header_add", "header_remove", "header_replace", "body_replace", "url_rewrite", "status_override"
+	HeaderName string `json:"header_name,omitempty"` // For header actions
+	Pattern    string `json:"pattern,omitempty"`     // Regular expression for replace and rewrite actions
+	Value      string `json:"value,omitempty"`       // Header value, replacement text or status code
+
+	host, path, header, body, pattern *regexp.Regexp
+}
+
+// Request is the part of a request that rules can read and modify
+type Request struct {
+	Method string
+	URL    string
+	Header http.Header
+	Body   []byte
+}
+
+// Response is the part of a response that rules can read and modify.
+// A nil Body means the body is streamed: body conditions never match and
+// body actions are skipped.
+type Response struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+var (
+	rules    []*Rule
+	rulesMu  sync.RWMutex
+	filePath string
+)
+
+// Init loads the rules from the configured file, by default next to the executable
+func Init() error {
+	return Load(config.ResolvePath(config.GetInstance().RulesPath, "shackododo-rules.json"))
+}
+
+// Load reads the rules from the given file, which is also used to persist
+// later changes. A missing file means no rules.
+func Load(path string) error {
+	rulesMu.Lock()
+	filePath = path
+	rulesMu.Unlock()
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var loaded []*Rule
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return fmt.Errorf("invalid rules file %s: %v", path, err)
+	}
+	for _, rule := range loaded {
+		if err := rule.compile(); err != nil {
+			return fmt.Errorf("rule %s: %v", rule.ID, err)
+		}
+	}
+
+	rulesMu.Lock()
+	rules = loaded
+	rulesMu.Unlock()
+	return nil
+}
+
+// List returns a copy of every rule
+func List() []Rule {
+	rulesMu.RLock()
+	defer rulesMu.RUnlock()
+
+	list := make([]Rule, 0, len(rules))
+	for _, rule := range rules {
+		list = append(list, *rule)
+	}
+	return list
+}
+
+// SetAll validates and replaces every rule, then persists them
+func SetAll(list []Rule) error {
+	compiled := make([]*Rule, 0, len(list))
+	for i := range list {
+		rule := list[i]
+		if err := rule.compile(); err != nil {
+			return fmt.Errorf("rule %d: %v", i+1, err)
+		}
+		compiled = append(compiled, &rule)
+	}
+
+	rulesMu.Lock()
+	defer rulesMu.Unlock()
+	rules = compiled
+	return save()
+}
+
+// Put adds a rule, or replaces the rule with the same ID, then persists
+func Put(rule Rule) (Rule, error) {
+	if err := rule.compile(); err != nil {
+		return rule, err
+	}
+
+	rulesMu.Lock()
+	defer rulesMu.Unlock()
+
+	replaced := false
+	for i, existing := range rules {
+		if existing.ID == rule.ID {
+			rules[i] = &rule
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		rules = append(rules, &rule)
+	}
+	return rule, save()
+}
+
+// Delete removes a rule by ID, then persists
+func Delete(id string) error {
+	rulesMu.Lock()
+	defer rulesMu.Unlock()
+
+	for i, rule := range rules {
+		if rule.ID == id {
+			rules = append(rules[:i], rules[i+1:]...)
+			return save()
+		}
+	}
+	return fmt.Errorf("rule %s not found", id)
+}
+
+// save writes the rules to disk. The caller must hold rulesMu.
+func save() error {
+	if filePath == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(rules, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filePath, data, 0o600)
+}
+
+// compile validates the rule and prepares its regular expressions
+func (r *Rule) compile() error {
+	if r.ID == "" {
+		r.ID = uuid.New().String()
+	}
+
+	switch r.Stage {
+	case "request", "response":
+	case "":
+		r.Stage = "request"
+	default:
+		return fmt.Errorf("invalid stage %q", r.Stage)
+	}
+
+	switch r.Action {
+	case "header_add", "header_remove", "header_replace":
+		if r.HeaderName == "" {
+			return fmt.Errorf("%s needs header_name", r.Action)
+		}
+	case "body_replace", "url_rewrite":
+		if r.Pattern == "" {
+			return fmt.Errorf("%s needs a pattern", r.Action)
+		}
+		if r.Action == "url_rewrite" && r.Stage != "request" {
+			return fmt.Errorf("url_rewrite only applies to requests")
+		}
+	case "status_override":
+		if r.Stage != "response" {
+			return fmt.Errorf("status_override only applies to responses")
+		}
+		if code, err := strconv.Atoi(r.Value); err != nil || code < 100 || code > 999 {
+			return fmt.Errorf("invalid status code %q", r.Value)
+		}
+	default:
+		return fmt.Errorf("invalid action %q", r.Action)
+	}
+
+	var err error
+	compile := func(name, expr string) *regexp.Regexp {
+		if expr == "" || err != nil {
+			return nil
+		}
+		re, compileErr := regexp.Compile(expr)
+		if compileErr != nil {
+			err = fmt.Errorf("%s: %v", name, compileErr)
+		}
+		return re
+	}
+	r.host = compile("host", r.Host)
+	r.path = compile("path", r.Path)
+	r.header = compile("header", r.Header)
+	r.body = compile("body", r.Body)
+	r.pattern = compile("pattern", r.Pattern)
+	return err
+}
+
+// matches checks the request conditions, then the header and body
+// conditions against the message of the rule's stage
+func (r *Rule) matches(method string, u *url.URL, header http.Header, body []byte) bool {
+	if r.Scheme != "" && !strings.EqualFold(u.Scheme, r.Scheme) {
+		return false
+	}
+	if r.host != nil && !r.host.MatchString(u.Hostname()) {
+		return false
+	}
+	if r.path != nil && !r.path.MatchString(u.Path) {
+		return false
+	}
+	if r.Method != "" && !strings.EqualFold(method, r.Method) {
+		return false
+	}
+	if r.header != nil {
+		found := false
+		for name, values := range header {
+			for _, value := range values {
+				if r.header.MatchString(name + ": " + value) {
+					found = true
+				}
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if r.body != nil && (body == nil || !r.body.Match(body)) {
+		return false
+	}
+	return true
+}
+
+// ApplyRequest applies every enabled request rule in order
+func ApplyRequest(req *Request) {
+	rulesMu.RLock()
+	defer rulesMu.RUnlock()
+
+	for _, rule := range rules {
+		if !rule.Enabled || rule.Stage != "request" {
+			continue
+		}
+		u, err := url.Parse(req.URL)
+		if err != nil {
+			return
+		}
+		if !rule.matches(req.Method, u, req.Header, req.Body) {
+			continue
+		}
+
+		switch rule.Action {
+		case "url_rewrite":
+			rewritten := rule.pattern.ReplaceAllString(req.URL, rule.Value)
+			if _, err := url.Parse(rewritten); err != nil {
+				log.Printf("Règle %s: URL réécrite invalide %q", rule.ID, rewritten)
+				continue
+			}
+			req.URL = rewritten
+		case "body_replace":
+			if req.Body != nil {
+				req.Body = rule.pattern.ReplaceAll(req.Body, []byte(rule.Value))
+			}
+		default:
+			rule.applyHeader(req.Header)
+		}
+	}
+}
+
+// ApplyResponse applies every enabled response rule in order. The request
+// method and URL are used for the scheme, host, path and method conditions.
+func ApplyResponse(method string, rawURL string, resp *Response) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return
+	}
+
+	rulesMu.RLock()
+	defer rulesMu.RUnlock()
+
+	for _, rule := range rules {
+		if !rule.Enabled || rule.Stage != "response" {
+			continue
+		}
+		if !rule.matches(method, u, resp.Header, resp.Body) {
+			continue
+		}
+
+		switch rule.Action {
+		case "status_override":
+			resp.StatusCode, _ = strconv.Atoi(rule.Value)
+		case "body_replace":
+			if resp.Body != nil {
+				resp.Body = rule.pattern.ReplaceAll(resp.Body, []byte(rule.Value))
+			}
+		default:
+			rule.applyHeader(resp.Header)
+		}
+	}
+}
+
+func (r *Rule) applyHeader(header http.Header) {
+	switch r.Action {
+	case "header_add":
+		header.Add(r.HeaderName, r.Value)
+	case "header_remove":
+		header.Del(r.HeaderName)
+	case "header_replace":
+		values := header.Values(r.HeaderName)
+		if r.pattern == nil || len(values) == 0 {
+			header.Set(r.HeaderName, r.Value)
+			return
+		}
+		replaced := make([]string, len(values))
+		for i, value := range values {
+			replaced[i] = r.pattern.ReplaceAllString(value, r.Value)
+		}
+		header[http.CanonicalHeaderKey(r.HeaderName)] = replaced
+	}
+}
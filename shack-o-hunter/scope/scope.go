@@ -0,0 +1,177 @@
+package scope
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// Rule matches traffic on host, port, scheme and path prefix. Empty fields
+// match everything.
+//
+// Host patterns:
+//   - "example.com"    exact host
+//   - ".example.com"   the domain and all its subdomains
+//   - "*.example.com"  wildcard, "*" matches within a single label
+//   - "10.0.0.0/8"     CIDR, matches IP hosts only
+type Rule struct {
+	Host   string `json:"host,omitempty"`
+	Port   int    `json:"port,omitempty"`
+	Scheme string `json:"scheme,omitempty"`
+	Path   string `json:"path,omitempty"` // Prefix
+}
+
+// Scope decides which traffic is in scope. With no include rule everything
+// is in scope unless excluded. The toggles apply to out-of-scope traffic.
+type Scope struct {
+	Include []Rule `json:"include"`
+	Exclude []Rule `json:"exclude"`
+
+	DontLog        bool `json:"dont_log"`        // Neither broadcast nor recorded in the history
+	DontIntercept  bool `json:"dont_intercept"`  // Never paused, even when pause is enabled
+	TLSPassthrough bool `json:"tls_passthrough"` // CONNECT tunnels are relayed without MITM
+}
+
+// Target is the traffic being checked. An empty Path means the path is not
+// known yet, e.g. when handling a CONNECT.
+type Target struct {
+	Host   string
+	Port   int
+	Scheme string
+	Path   string
+}
+
+// Decision tells the proxy how to handle a target
+type Decision struct {
+	InScope   bool
+	Log       bool
+	Intercept bool
+	MITM      bool
+}
+
+// Evaluate returns how the target must be handled
+func (s Scope) Evaluate(t Target) Decision {
+	if s.InScope(t) {
+		return Decision{InScope: true, Log: true, Intercept: true, MITM: true}
+	}
+	return Decision{
+		Log:       !s.DontLog,
+		Intercept: !s.DontLog && !s.DontIntercept,
+		MITM:      !s.TLSPassthrough,
+	}
+}
+
+// InScope returns true if the target matches an include rule and no exclude
+// rule. When the path is unknown, include rules ignore their path prefix and
+// exclude rules with a path prefix are skipped, so that a host is only
+// considered out of scope if it is for every path.
+func (s Scope) InScope(t Target) bool {
+	t.Host = strings.ToLower(strings.TrimSuffix(t.Host, "."))
+	t.Scheme = strings.ToLower(t.Scheme)
+
+	if len(s.Include) > 0 {
+		included := false
+		for _, rule := range s.Include {
+			if rule.matches(t, true) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return false
+		}
+	}
+
+	for _, rule := range s.Exclude {
+		if rule.matches(t, false) {
+			return false
+		}
+	}
+	return true
+}
+
+// Validate checks every rule and names the first invalid one
+func (s Scope) Validate() error {
+	for i, rule := range s.Include {
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("include[%d]: %v", i, err)
+		}
+	}
+	for i, rule := range s.Exclude {
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("exclude[%d]: %v", i, err)
+		}
+	}
+	return nil
+}
+
+func (r Rule) validate() error {
+	if r.Port < 0 || r.Port > 65535 {
+		return fmt.Errorf("invalid port %d", r.Port)
+	}
+	if err := ValidateHost(r.Host); err != nil {
+		return err
+	}
+	if r.Path != "" && !strings.HasPrefix(r.Path, "/") {
+		return fmt.Errorf("path prefix %q must start with /", r.Path)
+	}
+	return nil
+}
+
+// matches checks the rule against the target. unknownPathMatches tells
+// whether a path prefix matches when the target path is not known.
+func (r Rule) matches(t Target, unknownPathMatches bool) bool {
+	if r.Host != "" && !MatchHost(r.Host, t.Host) {
+		return false
+	}
+	if r.Port != 0 && r.Port != t.Port {
+		return false
+	}
+	if r.Scheme != "" && !strings.EqualFold(r.Scheme, t.Scheme) {
+		return false
+	}
+	if r.Path != "" {
+		if t.Path == "" {
+			return unknownPathMatches
+		}
+		if !strings.HasPrefix(t.Path, r.Path) {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidateHost checks the syntax of a host pattern, see Rule
+func ValidateHost(pattern string) error {
+	if strings.Contains(pattern, "/") {
+		if _, _, err := net.ParseCIDR(pattern); err != nil {
+			return fmt.Errorf("invalid CIDR %q", pattern)
+		}
+	}
+	return nil
+}
+
+// MatchHost checks a host against a pattern, see Rule for the syntax
+func MatchHost(pattern string, host string) bool {
+	pattern = strings.ToLower(pattern)
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	switch {
+	case strings.Contains(pattern, "/"):
+		_, network, err := net.ParseCIDR(pattern)
+		if err != nil {
+			return false
+		}
+		ip := net.ParseIP(strings.Trim(host, "[]"))
+		return ip != nil && network.Contains(ip)
+	case strings.HasPrefix(pattern, "."):
+		return host == pattern[1:] || strings.HasSuffix(host, pattern)
+	case strings.Contains(pattern, "*"):
+		expr := "^" + strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, `[^.]*`) + "$"
+		matched, _ := regexp.MatchString(expr, host)
+		return matched
+	default:
+		return host == pattern
+	}
+}
@@ -0,0 +1,127 @@
+package scope
+
+import "testing"
+
+func TestMatchHost(t *testing.T) {
+	tests := []struct {
+		pattern string
+		host    string
+		want    bool
+	}{
+		{"example.com", "example.com", true},
+		{"example.com", "EXAMPLE.com.", true},
+		{"example.com", "www.example.com", false},
+		{".example.com", "example.com", true},
+		{".example.com", "a.b.example.com", true},
+		{".example.com", "badexample.com", false},
+		{"*.example.com", "www.example.com", true},
+		{"*.example.com", "a.b.example.com", false},
+		{"*.example.com", "example.com", false},
+		{"api-*.example.com", "api-v2.example.com", true},
+		{"api-*.example.com", "web.example.com", false},
+		{"ex.mple.com", "exymple.com", false}, // Dots are not wildcards
+		{"10.0.0.0/8", "10.1.2.3", true},
+		{"10.0.0.0/8", "11.1.2.3", false},
+		{"10.0.0.0/8", "ten.example.com", false},
+		{"::1/128", "[::1]", true},
+		{"10.0.0.0/99", "10.0.0.1", false},
+	}
+	for _, tt := range tests {
+		if got := MatchHost(tt.pattern, tt.host); got != tt.want {
+			t.Errorf("MatchHost(%q, %q) = %v, want %v", tt.pattern, tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestInScope(t *testing.T) {
+	scope := Scope{
+		Include: []Rule{
+			{Host: ".example.com"},
+			{Host: "api.test", Port: 8443, Scheme: "https"},
+			{Host: "docs.test", Path: "/v2/"},
+		},
+		Exclude: []Rule{
+			{Host: "static.example.com"},
+			{Host: ".example.com", Path: "/logout"},
+		},
+	}
+	tests := []struct {
+		name   string
+		target Target
+		want   bool
+	}{
+		{"included domain", Target{Host: "www.example.com", Port: 443, Scheme: "https", Path: "/"}, true},
+		{"case and trailing dot", Target{Host: "WWW.Example.COM.", Port: 80, Scheme: "HTTP", Path: "/"}, true},
+		{"not included", Target{Host: "other.test", Port: 443, Scheme: "https", Path: "/"}, false},
+		{"excluded host", Target{Host: "static.example.com", Port: 443, Scheme: "https", Path: "/"}, false},
+		{"excluded path", Target{Host: "example.com", Port: 443, Scheme: "https", Path: "/logout/now"}, false},
+		{"unknown path ignores path exclusions", Target{Host: "example.com", Port: 443, Scheme: "https"}, true},
+		{"port and scheme", Target{Host: "api.test", Port: 8443, Scheme: "https", Path: "/"}, true},
+		{"wrong port", Target{Host: "api.test", Port: 443, Scheme: "https", Path: "/"}, false},
+		{"wrong scheme", Target{Host: "api.test", Port: 8443, Scheme: "http", Path: "/"}, false},
+		{"path prefix", Target{Host: "docs.test", Port: 443, Scheme: "https", Path: "/v2/intro"}, true},
+		{"other path", Target{Host: "docs.test", Port: 443, Scheme: "https", Path: "/v1/intro"}, false},
+		{"unknown path matches path inclusions", Target{Host: "docs.test", Port: 443, Scheme: "https"}, true},
+	}
+	for _, tt := range tests {
+		if got := scope.InScope(tt.target); got != tt.want {
+			t.Errorf("%s: InScope(%+v) = %v, want %v", tt.name, tt.target, got, tt.want)
+		}
+	}
+
+	if !(Scope{}).InScope(Target{Host: "anything.test"}) {
+		t.Error("an empty scope must include everything")
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	inScope := Target{Host: "in.test", Port: 443, Scheme: "https", Path: "/"}
+	outOfScope := Target{Host: "out.test", Port: 443, Scheme: "https", Path: "/"}
+	include := []Rule{{Host: "in.test"}}
+
+	tests := []struct {
+		name   string
+		scope  Scope
+		target Target
+		want   Decision
+	}{
+		{"in scope", Scope{Include: include, DontLog: true, DontIntercept: true, TLSPassthrough: true}, inScope,
+			Decision{InScope: true, Log: true, Intercept: true, MITM: true}},
+		{"out of scope, default toggles", Scope{Include: include}, outOfScope,
+			Decision{Log: true, Intercept: true, MITM: true}},
+		{"out of scope, not logged", Scope{Include: include, DontLog: true}, outOfScope,
+			Decision{MITM: true}},
+		{"out of scope, not intercepted", Scope{Include: include, DontIntercept: true}, outOfScope,
+			Decision{Log: true, MITM: true}},
+		{"out of scope, passthrough", Scope{Include: include, TLSPassthrough: true}, outOfScope,
+			Decision{Log: true, Intercept: true}},
+	}
+	for _, tt := range tests {
+		if got := tt.scope.Evaluate(tt.target); got != tt.want {
+			t.Errorf("%s: Evaluate = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		scope   Scope
+		wantErr string
+	}{
+		{"valid", Scope{Include: []Rule{{Host: "10.0.0.0/8", Port: 443, Path: "/api"}}}, ""},
+		{"bad CIDR", Scope{Include: []Rule{{Host: "10.0.0.0/99"}}}, `include[0]: invalid CIDR "10.0.0.0/99"`},
+		{"bad port", Scope{Exclude: []Rule{{}, {Port: 70000}}}, "exclude[1]: invalid port 70000"},
+		{"bad path", Scope{Exclude: []Rule{{Path: "api"}}}, `exclude[0]: path prefix "api" must start with /`},
+	}
+	for _, tt := range tests {
+		err := tt.scope.Validate()
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != tt.wantErr {
+			t.Errorf("%s: Validate() = %q, want %q", tt.name, got, tt.wantErr)
+		}
+	}
+}
@@ -4,16 +4,22 @@ import (
 	"embed"
 	"io/fs"
 	"log"
+	"net"
 	"net/http"
 	"os/exec"
+	"proxy-interceptor/config"
 	"runtime"
+	"strconv"
 	"time"
 )
 
 //go:embed all:dist
 var distFS embed.FS
 
-func Start(port string) {
+func Start() {
+	cfg := config.GetInstance()
+	port := strconv.Itoa(cfg.FrontendPort)
+
 	// Vérifier si le dossier dist existe dans l'embed
 	distSub, err := fs.Sub(distFS, "dist")
 	if err != nil {
@@ -46,11 +52,15 @@ func Start(port string) {
 
 	go func() {
 		log.Printf("Frontend React démarré sur http://localhost:%s", port)
-		if err := http.ListenAndServe(":"+port, nil); err != nil {
+		if err := http.ListenAndServe(net.JoinHostPort(cfg.FrontendAddress, port), nil); err != nil {
 			log.Printf("Erreur serveur HTTP: %v", err)
 		}
 	}()
 
+	if !cfg.AutoOpen {
+		return
+	}
+
 	// Attendre un peu que le serveur démarre, puis ouvrir le navigateur
 	time.Sleep(500 * time.Millisecond)
 	openBrowser("http://localhost:" + port)
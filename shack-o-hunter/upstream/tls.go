@@ -0,0 +1,134 @@
+package upstream
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"proxy-interceptor/scope"
+	"strings"
+	"sync"
+)
+
+// TLSPolicy decides which server certificates are trusted on outbound
+// connections
+type TLSPolicy struct {
+	Verify         bool     `json:"verify"`          // Refuse servers whose certificate is not trusted, false accepts any
+	CABundles      []string `json:"ca_bundles"`      // PEM files of CAs trusted besides the system roots
+	IgnoreHosts    []string `json:"ignore_hosts"`    // Host patterns whose certificate errors are ignored
+	ReflectInvalid bool     `json:"reflect_invalid"` // Show the client an invalid certificate instead of refusing the server
+}
+
+// Validate checks every host pattern and CA bundle and names the first invalid one
+func (p TLSPolicy) Validate() error {
+	for i, path := range p.CABundles {
+		if _, err := loadBundle(path); err != nil {
+			return fmt.Errorf("ca_bundles[%d]: %v", i, err)
+		}
+	}
+	for i, pattern := range p.IgnoreHosts {
+		if err := validatePattern(pattern); err != nil {
+			return fmt.Errorf("ignore_hosts[%d]: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// Ignores tells whether certificate errors of host are ignored
+func (p TLSPolicy) Ignores(host string) bool {
+	for _, pattern := range p.IgnoreHosts {
+		if scope.MatchHost(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check verifies a server's chain, leaf first, against the system roots and
+// the CA bundles. host is not checked when empty.
+func (p TLSPolicy) Check(chain []*x509.Certificate, host string) error {
+	if len(chain) == 0 {
+		return fmt.Errorf("no certificate presented")
+	}
+	roots, err := rootPool(p.CABundles)
+	if err != nil {
+		return err
+	}
+	intermediates := x509.NewCertPool()
+	for _, c := range chain[1:] {
+		intermediates.AddCert(c)
+	}
+	_, err = chain[0].Verify(x509.VerifyOptions{
+		DNSName:       host,
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	return err
+}
+
+// roots caches the pool built for the last list of bundles, which seldom changes
+var roots struct {
+	mu   sync.Mutex
+	key  string
+	pool *x509.CertPool
+}
+
+// rootPool returns the system roots with the certificates of the bundles
+// added. Without bundles it is nil, which lets x509 use the platform
+// verifier.
+func rootPool(bundles []string) (*x509.CertPool, error) {
+	if len(bundles) == 0 {
+		return nil, nil
+	}
+
+	key := strings.Join(bundles, "\n")
+	roots.mu.Lock()
+	defer roots.mu.Unlock()
+	if roots.pool != nil && roots.key == key {
+		return roots.pool, nil
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	for _, path := range bundles {
+		certs, err := loadBundle(path)
+		if err != nil {
+			return nil, fmt.Errorf("CA bundle %s: %v", path, err)
+		}
+		for _, c := range certs {
+			pool.AddCert(c)
+		}
+	}
+	roots.key, roots.pool = key, pool
+	return pool, nil
+}
+
+// loadBundle reads the certificates of a PEM file
+func loadBundle(path string) ([]*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		c, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, c)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no PEM certificate in %s", path)
+	}
+	return certs, nil
+}
@@ -1,5 +1,10 @@
 package websocket
 
+import (
+	"encoding/json"
+	"proxy-interceptor/history"
+)
+
 type Message struct {
 	Type string `json:"type"`
 	ID   string `json:"id,omitempty"`
@@ -11,6 +16,64 @@ type RequestData struct {
 	URL     string              `json:"url"`
 	Headers map[string][]string `json:"headers"`
 	Body    string              `json:"body"`
-	Status  string              `json:"status,omitempty"` // "pending", "sent", "dropped"
-	Action  string              `json:"action,omitempty"` // "send", "drop"
+	BodyInfo
+	Status string `json:"status,omitempty"` // "pending", "sent", "dropped"
+	Action string `json:"action,omitempty"` // "send", "drop"
+}
+
+type ResponseData struct {
+	StatusCode int                 `json:"status_code"`
+	Headers    map[string][]string `json:"headers"`
+	Body       string              `json:"body"`
+	BodyInfo
+	Status string `json:"status,omitempty"` // "pending", "passthrough"
+	Action string `json:"action,omitempty"` // "send", "drop"
+
+	UpstreamTLS *history.TLSInfo `json:"upstream_tls,omitempty"` // Server certificate and its verification
+	Error       string           `json:"error,omitempty"`        // Why no response could be obtained
+}
+
+// BodyInfo tells how a body is sent. Streamed bodies, larger than the memory
+// limit, only come as a preview and can be neither paused nor edited.
+type BodyInfo struct {
+	Encoding  string `json:"encoding,omitempty"`  // "base64" or "hex" when the body is not UTF-8
+	Size      int64  `json:"size"`                // Whole body size in bytes
+	Truncated bool   `json:"truncated,omitempty"` // Body is a preview
+
+	// Compressed bodies are shown and edited decoded, then compressed again
+	ContentEncoding string `json:"content_encoding,omitempty"` // The body was decoded from, e.g. "gzip"
+	Raw             string `json:"raw,omitempty"`              // Bytes as received in base64, for decoded bodies
+	SendRaw         bool   `json:"send_raw,omitempty"`         // The edited body is raw bytes to send unchanged
+}
+
+// FrameData is a WebSocket frame relayed by the proxy. Its message ID is the frame ID.
+type FrameData struct {
+	EntryID   string `json:"entry_id"`  // History entry of the upgrade request
+	Direction string `json:"direction"` // "client", "server"
+	Opcode    int    `json:"opcode"`
+	Fin       bool   `json:"fin"`
+	Payload   string `json:"payload"`
+	Encoding  string `json:"encoding,omitempty"` // "base64" for binary payloads
+	Status    string `json:"status,omitempty"`   // "pending", "passthrough"
+	Action    string `json:"action,omitempty"`   // "send", "drop"
+}
+
+type RepeatRequest struct {
+	ID              string              `json:"-"`
+	Action          string              `json:"-"` // "send", "history", "clear"
+	Tab             string              `json:"tab"`
+	EntryID         string              `json:"entry_id,omitempty"` // History entry to start from
+	Method          string              `json:"method,omitempty"`
+	URL             string              `json:"url,omitempty"`
+	Headers         map[string][]string `json:"headers,omitempty"`
+	Body            string              `json:"body,omitempty"`
+	Encoding        string              `json:"encoding,omitempty"` // "base64" or "hex" for a binary body
+	SendRaw         bool                `json:"send_raw,omitempty"` // Body is sent as is, not compressed per Content-Encoding
+	FollowRedirects bool                `json:"follow_redirects,omitempty"`
+}
+
+type IntruderRequest struct {
+	ID     string          // Attack ID chosen by the UI
+	Action string          // "start", "stop"
+	Attack json.RawMessage // Attack definition, decoded by the intruder module
 }
@@ -2,10 +2,17 @@ package websocket
 
 import (
 	"encoding/json"
-	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"proxy-interceptor/clientcert"
 	"proxy-interceptor/config"
+	"proxy-interceptor/har"
+	"proxy-interceptor/history"
+	"proxy-interceptor/rules"
+	"proxy-interceptor/scope"
+	"proxy-interceptor/upstream"
+	"strconv"
 	"sync"
 	"time"
 
@@ -27,6 +34,13 @@ type BrowserLaunchRequest struct {
 
 var BrowserLaunchChannel = make(chan BrowserLaunchRequest, 10)
 
+// RepeatChannel carries repeater commands to the repeater module, which
+// depends on the proxy and therefore cannot be imported from here
+var RepeatChannel = make(chan RepeatRequest, 10)
+
+// IntruderChannel carries fuzzing commands to the intruder module
+var IntruderChannel = make(chan IntruderRequest, 10)
+
 // Hub maintains the set of active clients
 type Hub struct {
 	// Registered clients
@@ -48,6 +62,10 @@ type Client struct {
 
 	// Outbound messages
 	send chan []byte
+
+	// Guards send against a reply racing the hub closing it
+	sendMutex sync.Mutex
+	closed    bool
 }
 
 var hub = Hub{
@@ -66,8 +84,12 @@ var BroadcastChannel = make(chan []byte)
 var ModifyChannel = make(chan RequestData, 100)
 var PendingModifications = make(map[string]RequestData)
 var PendingRequests = make(map[string]chan RequestData)
+var PendingResponses = make(map[string]chan ResponseData)
+var PendingFrames = make(map[string]chan FrameData)
 var modifyMutex sync.RWMutex
 var requestMutex sync.RWMutex
+var responseMutex sync.RWMutex
+var frameMutex sync.RWMutex
 
 func (h *Hub) run() {
 	for {
@@ -77,14 +99,14 @@ func (h *Hub) run() {
 		case client := <-h.unregister:
 			if _, ok := h.clients[client]; ok {
 				delete(h.clients, client)
-				close(client.send)
+				client.closeSend()
 			}
 		case message := <-BroadcastChannel:
 			for client := range h.clients {
 				select {
 				case client.send <- message:
 				default:
-					close(client.send)
+					client.closeSend()
 					delete(h.clients, client)
 				}
 			}
@@ -125,6 +147,29 @@ func (c *Client) readPump() {
 			} else {
 				log.Printf("Invalid data for pause type: %v", msg.Data)
 			}
+		case "pause_responses":
+			if pause, ok := msg.Data.(bool); ok {
+				config.GetInstance().SetPauseResponses(pause)
+				log.Printf("Set response pause to %v", pause)
+
+				// Si on désactive la pause, envoyer toutes les réponses pending
+				if !pause {
+					go ResumePendingResponses()
+				}
+			} else {
+				log.Printf("Invalid data for pause_responses type: %v", msg.Data)
+			}
+		case "pause_websocket":
+			if pause, ok := msg.Data.(bool); ok {
+				config.GetInstance().SetPauseWebSocket(pause)
+				log.Printf("Set WebSocket frame pause to %v", pause)
+
+				if !pause {
+					go ResumePendingFrames()
+				}
+			} else {
+				log.Printf("Invalid data for pause_websocket type: %v", msg.Data)
+			}
 		case "launch_browser":
 			// Lancement d'un navigateur spécifique
 			if browserData, ok := msg.Data.(map[string]interface{}); ok {
@@ -137,46 +182,20 @@ func (c *Client) readPump() {
 		case "resume_all":
 			// Envoyer toutes les requêtes en attente
 			go ResumePendingRequests()
+			go ResumePendingResponses()
+			go ResumePendingFrames()
 		case "modify_request":
 			if modifyData, ok := msg.Data.(map[string]interface{}); ok {
 				modify := RequestData{
-					Method: getString(modifyData, "method"),
-					URL:    getString(modifyData, "url"),
-					Body:   getString(modifyData, "body"),
-					Action: getString(modifyData, "action"),
+					Method:   getString(modifyData, "method"),
+					URL:      getString(modifyData, "url"),
+					Body:     getString(modifyData, "body"),
+					BodyInfo: bodyInfo(modifyData),
+					Action:   getString(modifyData, "action"),
 				}
 
 				if headersData, exists := modifyData["headers"]; exists {
-					modify.Headers = make(map[string][]string)
-
-					switch h := headersData.(type) {
-					case map[string]interface{}:
-						for k, v := range h {
-							switch val := v.(type) {
-							case string:
-								modify.Headers[k] = []string{val}
-							case []interface{}:
-								var strSlice []string
-								for _, item := range val {
-									if str, ok := item.(string); ok {
-										strSlice = append(strSlice, str)
-									}
-								}
-								if len(strSlice) > 0 {
-									modify.Headers[k] = strSlice
-								}
-							}
-						}
-					case string:
-						var headerMap map[string]interface{}
-						if err := json.Unmarshal([]byte(h), &headerMap); err == nil {
-							for k, v := range headerMap {
-								if strValue, ok := v.(string); ok {
-									modify.Headers[k] = []string{strValue}
-								}
-							}
-						}
-					}
+					modify.Headers = parseHeaders(headersData)
 				}
 
 				requestID := msg.ID
@@ -200,8 +219,305 @@ func (c *Client) readPump() {
 				default:
 				}
 			}
+		case "history_query":
+			var filter history.Filter
+			if err := decodeData(msg.Data, &filter); err != nil {
+				log.Printf("Invalid data for history_query type: %v", err)
+				continue
+			}
+			c.reply(Message{Type: "history", ID: msg.ID, Data: history.Query(filter)})
+		case "history_get":
+			entry, exists := history.Get(msg.ID)
+			if !exists {
+				c.reply(Message{Type: "error", ID: msg.ID, Data: "history entry not found"})
+				continue
+			}
+			c.reply(Message{Type: "history_entry", ID: msg.ID, Data: entry})
+		case "history_clear":
+			if err := history.Clear(); err != nil {
+				log.Printf("Erreur lors de l'effacement de l'historique: %v", err)
+			}
+		case "har_export":
+			var filter history.Filter
+			if msg.Data != nil {
+				if err := decodeData(msg.Data, &filter); err != nil {
+					log.Printf("Invalid data for har_export type: %v", err)
+					continue
+				}
+			}
+			c.reply(Message{Type: "har", ID: msg.ID, Data: har.Export(history.Entries(filter))})
+		case "har_import":
+			// The HAR can be sent either as an object or as the raw file content
+			var doc har.HAR
+			var err error
+			if text, ok := msg.Data.(string); ok {
+				err = json.Unmarshal([]byte(text), &doc)
+			} else {
+				err = decodeData(msg.Data, &doc)
+			}
+			entries, importErr := har.ImportHAR(doc)
+			if err == nil {
+				err = importErr
+			}
+			if err != nil {
+				c.reply(Message{Type: "error", ID: msg.ID, Data: err.Error()})
+				continue
+			}
+			for i := range entries {
+				history.Save(&entries[i])
+			}
+			log.Printf("Imported %d HAR entries", len(entries))
+			c.reply(Message{Type: "har_imported", ID: msg.ID, Data: map[string]int{"count": len(entries)}})
+		case "repeat_request", "repeat_history", "repeat_clear":
+			var repeat RepeatRequest
+			if err := decodeData(msg.Data, &repeat); err != nil {
+				log.Printf("Invalid data for %s type: %v", msg.Type, err)
+				continue
+			}
+			repeat.ID = msg.ID
+			switch msg.Type {
+			case "repeat_request":
+				repeat.Action = "send"
+			case "repeat_history":
+				repeat.Action = "history"
+			case "repeat_clear":
+				repeat.Action = "clear"
+			}
+			RepeatChannel <- repeat
+		case "intruder_start", "intruder_stop":
+			intruderRequest := IntruderRequest{ID: msg.ID, Action: "start"}
+			if msg.Type == "intruder_stop" {
+				intruderRequest.Action = "stop"
+			} else {
+				raw, err := json.Marshal(msg.Data)
+				if err != nil {
+					log.Printf("Invalid data for %s type: %v", msg.Type, err)
+					continue
+				}
+				intruderRequest.Attack = raw
+			}
+			IntruderChannel <- intruderRequest
+		case "rules_get":
+			c.reply(Message{Type: "rules", ID: msg.ID, Data: rules.List()})
+		case "rules_set":
+			var list []rules.Rule
+			err := decodeData(msg.Data, &list)
+			if err == nil {
+				err = rules.SetAll(list)
+			}
+			if err != nil {
+				c.reply(Message{Type: "error", ID: msg.ID, Data: err.Error()})
+				continue
+			}
+			c.reply(Message{Type: "rules", ID: msg.ID, Data: rules.List()})
+		case "rule_save":
+			var rule rules.Rule
+			err := decodeData(msg.Data, &rule)
+			if err == nil {
+				rule, err = rules.Put(rule)
+			}
+			if err != nil {
+				c.reply(Message{Type: "error", ID: msg.ID, Data: err.Error()})
+				continue
+			}
+			c.reply(Message{Type: "rule", ID: msg.ID, Data: rule})
+		case "rule_delete":
+			if err := rules.Delete(msg.ID); err != nil {
+				c.reply(Message{Type: "error", ID: msg.ID, Data: err.Error()})
+				continue
+			}
+			c.reply(Message{Type: "rules", ID: msg.ID, Data: rules.List()})
+		case "client_certs_get":
+			c.reply(Message{Type: "client_certs", ID: msg.ID, Data: clientcert.List()})
+		case "client_cert_save":
+			var cert clientcert.Cert
+			err := decodeData(msg.Data, &cert)
+			if err == nil {
+				cert, err = clientcert.Put(cert)
+			}
+			if err != nil {
+				c.reply(Message{Type: "error", ID: msg.ID, Data: err.Error()})
+				continue
+			}
+			log.Printf("Client certificate saved: %s (%s) for %s", cert.Name, cert.Subject, cert.Host)
+			c.reply(Message{Type: "client_cert", ID: msg.ID, Data: cert})
+		case "client_cert_delete":
+			if err := clientcert.Delete(msg.ID); err != nil {
+				c.reply(Message{Type: "error", ID: msg.ID, Data: err.Error()})
+				continue
+			}
+			c.reply(Message{Type: "client_certs", ID: msg.ID, Data: clientcert.List()})
+		case "scope_get":
+			c.reply(Message{Type: "scope", ID: msg.ID, Data: config.GetInstance().GetScope()})
+		case "scope_set":
+			var s scope.Scope
+			err := decodeData(msg.Data, &s)
+			if err == nil {
+				err = config.GetInstance().SetScope(s)
+			}
+			if err != nil {
+				c.reply(Message{Type: "error", ID: msg.ID, Data: err.Error()})
+				continue
+			}
+			log.Printf("Scope updated: %d include, %d exclude rules", len(s.Include), len(s.Exclude))
+			if err := config.GetInstance().Save("scope"); err != nil {
+				log.Printf("Erreur lors de l'enregistrement de la configuration: %v", err)
+			}
+			c.reply(Message{Type: "scope", ID: msg.ID, Data: config.GetInstance().GetScope()})
+		case "upstream_get":
+			c.reply(Message{Type: "upstream", ID: msg.ID, Data: config.GetInstance().GetUpstream()})
+		case "upstream_set":
+			var u upstream.Settings
+			err := decodeData(msg.Data, &u)
+			if err == nil {
+				err = config.GetInstance().SetUpstream(u)
+			}
+			if err != nil {
+				c.reply(Message{Type: "error", ID: msg.ID, Data: err.Error()})
+				continue
+			}
+			log.Printf("Upstream proxy updated: %q, %d routes, %d bypass", u.Proxy, len(u.Routes), len(u.Bypass))
+			if err := config.GetInstance().Save("upstream"); err != nil {
+				log.Printf("Erreur lors de l'enregistrement de la configuration: %v", err)
+			}
+			c.reply(Message{Type: "upstream", ID: msg.ID, Data: config.GetInstance().GetUpstream()})
+		case "upstream_tls_get":
+			c.reply(Message{Type: "upstream_tls", ID: msg.ID, Data: config.GetInstance().GetUpstreamTLS()})
+		case "upstream_tls_set":
+			var p upstream.TLSPolicy
+			err := decodeData(msg.Data, &p)
+			if err == nil {
+				err = config.GetInstance().SetUpstreamTLS(p)
+			}
+			if err != nil {
+				c.reply(Message{Type: "error", ID: msg.ID, Data: err.Error()})
+				continue
+			}
+			log.Printf("Server certificate policy updated: verify=%v, %d CA bundles, %d ignored hosts, reflect=%v", p.Verify, len(p.CABundles), len(p.IgnoreHosts), p.ReflectInvalid)
+			if err := config.GetInstance().Save("upstream_tls"); err != nil {
+				log.Printf("Erreur lors de l'enregistrement de la configuration: %v", err)
+			}
+			c.reply(Message{Type: "upstream_tls", ID: msg.ID, Data: config.GetInstance().GetUpstreamTLS()})
+		case "modify_frame":
+			var modify FrameData
+			if err := decodeData(msg.Data, &modify); err != nil {
+				c.reply(Message{Type: "error", ID: msg.ID, Data: err.Error()})
+				continue
+			}
+
+			frameMutex.Lock()
+			if waitChan, exists := PendingFrames[msg.ID]; exists {
+				select {
+				case waitChan <- modify:
+				default:
+				}
+				delete(PendingFrames, msg.ID)
+			}
+			frameMutex.Unlock()
+		case "modify_response":
+			if modifyData, ok := msg.Data.(map[string]interface{}); ok {
+				modify := ResponseData{
+					Body:     getString(modifyData, "body"),
+					BodyInfo: bodyInfo(modifyData),
+					Action:   getString(modifyData, "action"),
+				}
+				if statusCode, ok := modifyData["status_code"].(float64); ok {
+					modify.StatusCode = int(statusCode)
+				}
+
+				if headersData, exists := modifyData["headers"]; exists {
+					modify.Headers = parseHeaders(headersData)
+				}
+
+				responseMutex.Lock()
+				if waitChan, exists := PendingResponses[msg.ID]; exists {
+					select {
+					case waitChan <- modify:
+					default:
+					}
+					delete(PendingResponses, msg.ID)
+				}
+				responseMutex.Unlock()
+			}
+		}
+	}
+}
+
+// reply sends a message to this client only
+func (c *Client) reply(msg Message) {
+	jsonData, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("Error marshaling JSON: %v", err)
+		return
+	}
+
+	c.sendMutex.Lock()
+	defer c.sendMutex.Unlock()
+	if c.closed {
+		// The client has been unregistered
+		return
+	}
+	select {
+	case c.send <- jsonData:
+	default:
+		log.Printf("Client send buffer full, dropping %s reply", msg.Type)
+	}
+}
+
+// closeSend closes the outbound channel, which ends writePump
+func (c *Client) closeSend() {
+	c.sendMutex.Lock()
+	defer c.sendMutex.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.send)
+	}
+}
+
+// decodeData converts the generic Data of a message into a typed value
+func decodeData(data any, v any) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
+
+// parseHeaders converts headers sent by the UI, either as an object or as a
+// JSON string, into an http.Header-like map
+func parseHeaders(headersData interface{}) map[string][]string {
+	headers := make(map[string][]string)
+
+	switch h := headersData.(type) {
+	case map[string]interface{}:
+		for k, v := range h {
+			switch val := v.(type) {
+			case string:
+				headers[k] = []string{val}
+			case []interface{}:
+				var strSlice []string
+				for _, item := range val {
+					if str, ok := item.(string); ok {
+						strSlice = append(strSlice, str)
+					}
+				}
+				if len(strSlice) > 0 {
+					headers[k] = strSlice
+				}
+			}
+		}
+	case string:
+		var headerMap map[string]interface{}
+		if err := json.Unmarshal([]byte(h), &headerMap); err == nil {
+			for k, v := range headerMap {
+				if strValue, ok := v.(string); ok {
+					headers[k] = []string{strValue}
+				}
+			}
 		}
 	}
+
+	return headers
 }
 
 func (c *Client) writePump() {
@@ -276,6 +592,80 @@ func ResumePendingRequests() {
 	}
 }
 
+func WaitForResponseModification(id string, timeout time.Duration) (ResponseData, bool) {
+	waitChan := make(chan ResponseData, 1)
+
+	responseMutex.Lock()
+	PendingResponses[id] = waitChan
+	responseMutex.Unlock()
+
+	select {
+	case modification := <-waitChan:
+		return modification, true
+	case <-time.After(timeout):
+		responseMutex.Lock()
+		delete(PendingResponses, id)
+		responseMutex.Unlock()
+		return ResponseData{}, false
+	}
+}
+
+func ResumePendingResponses() {
+	responseMutex.Lock()
+	defer responseMutex.Unlock()
+
+	count := 0
+	for id, waitChan := range PendingResponses {
+		select {
+		case waitChan <- ResponseData{Action: "send"}:
+			count++
+		default:
+		}
+		delete(PendingResponses, id)
+	}
+
+	if count > 0 {
+		log.Printf("Resumed %d pending responses", count)
+	}
+}
+
+func WaitForFrameModification(id string, timeout time.Duration) (FrameData, bool) {
+	waitChan := make(chan FrameData, 1)
+
+	frameMutex.Lock()
+	PendingFrames[id] = waitChan
+	frameMutex.Unlock()
+
+	select {
+	case modification := <-waitChan:
+		return modification, true
+	case <-time.After(timeout):
+		frameMutex.Lock()
+		delete(PendingFrames, id)
+		frameMutex.Unlock()
+		return FrameData{}, false
+	}
+}
+
+func ResumePendingFrames() {
+	frameMutex.Lock()
+	defer frameMutex.Unlock()
+
+	count := 0
+	for id, waitChan := range PendingFrames {
+		select {
+		case waitChan <- FrameData{Action: "send"}:
+			count++
+		default:
+		}
+		delete(PendingFrames, id)
+	}
+
+	if count > 0 {
+		log.Printf("Resumed %d pending WebSocket frames", count)
+	}
+}
+
 func StorePendingModification(id string, modification RequestData) {
 	modifyMutex.Lock()
 	defer modifyMutex.Unlock()
@@ -300,6 +690,12 @@ func getString(data map[string]interface{}, key string) string {
 	return ""
 }
 
+// bodyInfo reads how an edited body is encoded
+func bodyInfo(data map[string]interface{}) BodyInfo {
+	sendRaw, _ := data["send_raw"].(bool)
+	return BodyInfo{Encoding: getString(data, "encoding"), SendRaw: sendRaw}
+}
+
 func Start() {
 	go hub.run()
 	wsMux := http.NewServeMux()
@@ -308,7 +704,7 @@ func Start() {
 	})
 	go func() {
 		cfg := config.GetInstance()
-		addr := fmt.Sprintf("127.0.0.1:%d", cfg.WebSocketPort)
+		addr := net.JoinHostPort(cfg.WebSocketAddress, strconv.Itoa(cfg.WebSocketPort))
 		log.Printf("WebSocket server on %s", addr)
 		log.Fatal(http.ListenAndServe(addr, wsMux))
 	}()